@@ -0,0 +1,215 @@
+package container_image
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+const (
+	// continuationReserve is the time before the deadline of the invocation at which a copy stops, to
+	// continue in a new invocation.
+	continuationReserve = time.Minute
+	// continuationTimeout is the maximum time of a copy over all invocations, within the hour CloudFormation
+	// waits for the response of a custom resource.
+	continuationTimeout = 55 * time.Minute
+)
+
+// errContinued is returned when the request continues in a new invocation, which sends the response.
+var errContinued = errors.New("the request continues in a new invocation")
+
+// Event is the event the provider is invoked with: a custom resource request of CloudFormation, or a
+// request continued by a previous invocation which ran out of time.
+type Event struct {
+	cfn.Event
+	ContinuationToken string `json:"ContinuationToken,omitempty"`
+}
+
+// continuation is the progress of a copy over the invocations of the provider. The copy does not record
+// which blobs were uploaded: a new invocation resumes the copy because the pusher checks whether a blob
+// exists in the target registry before it uploads it.
+type continuation struct {
+	// Invocations is the number of invocations which ran out of time.
+	Invocations int `json:"invocations"`
+	// StartTime is the start of the first invocation.
+	StartTime time.Time `json:"startTime"`
+	// Blobs is the number of blobs uploaded to or mounted in the target repositories by all invocations.
+	Blobs int `json:"blobs,omitempty"`
+
+	mu sync.Mutex
+	// uploaded is the number of blobs uploaded by this invocation.
+	uploaded int
+}
+
+// contextKey is the type of the context values of the package.
+type contextKey string
+
+const continuationKey = contextKey("continuation")
+
+// getContinuation returns the continuation of the token, or a new continuation if the token is empty.
+func getContinuation(token string) (*continuation, error) {
+	if token == "" {
+		return &continuation{StartTime: time.Now().UTC()}, nil
+	}
+	content, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ContinuationToken, %s", err)
+	}
+	result := &continuation{}
+	if err = json.Unmarshal(content, result); err != nil {
+		return nil, fmt.Errorf("invalid ContinuationToken, %s", err)
+	}
+	return result, nil
+}
+
+// token returns the continuation token with the progress of the copy.
+func (c *continuation) token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	content, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(content), nil
+}
+
+// addBlob records the upload of a blob.
+func (c *continuation) addBlob() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Blobs++
+	c.uploaded++
+}
+
+// getProgress returns the continuation of the copy in the context, or nil.
+func getProgress(ctx context.Context) *continuation {
+	result, _ := ctx.Value(continuationKey).(*continuation)
+	return result
+}
+
+// progressTransport records the blobs which are uploaded to or mounted in a registry.
+type progressTransport struct {
+	inner    http.RoundTripper
+	progress *continuation
+}
+
+func (t *progressTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.inner.RoundTrip(request)
+	if err == nil && response.StatusCode == http.StatusCreated && strings.Contains(request.URL.Path, "/blobs/uploads/") {
+		if query := request.URL.Query(); query.Get("digest") != "" || query.Get("mount") != "" {
+			t.progress.addBlob()
+		}
+	}
+	return response, err
+}
+
+// run calls the copy operation with a deadline before the deadline of the invocation. If the copy runs out of time,
+// the request is continued in a new invocation of the provider and errContinued is returned. Without a
+// continuation, the copy is called with the context of the invocation.
+func (c *continuation) run(ctx context.Context, event cfn.Event, invoker lambdaiface.LambdaAPI, operation func(ctx context.Context) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if c == nil || !ok {
+		return operation(ctx)
+	}
+
+	copyCtx, cancel := context.WithDeadline(context.WithValue(ctx, continuationKey, c), deadline.Add(-continuationReserve))
+	defer cancel()
+	data, err := operation(copyCtx)
+	if err != nil && copyCtx.Err() != nil && ctx.Err() == nil {
+		log.Printf("the copy ran out of time, %s", err)
+		return nil, c.continueRequest(ctx, event, invoker)
+	}
+	return data, err
+}
+
+// continueRequest invokes the provider asynchronously with the request and the progress of the copy. It
+// returns errContinued, or the reason the copy cannot continue.
+func (c *continuation) continueRequest(ctx context.Context, event cfn.Event, invoker lambdaiface.LambdaAPI) error {
+	c.mu.Lock()
+	uploaded := c.uploaded
+	c.mu.Unlock()
+	if uploaded == 0 {
+		return fmt.Errorf("the copy did not upload a blob before the Lambda timeout")
+	}
+	if elapsed := time.Since(c.StartTime); elapsed > continuationTimeout {
+		return fmt.Errorf("the copy did not complete within %s", continuationTimeout)
+	}
+	lc, ok := lambdacontext.FromContext(ctx)
+	if !ok {
+		return fmt.Errorf("the copy did not complete before the deadline")
+	}
+
+	c.Invocations++
+	token, err := c.token()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(Event{Event: event, ContinuationToken: token})
+	if err != nil {
+		return err
+	}
+	_, err = invoker.Invoke(&lambda.InvokeInput{
+		FunctionName:   aws.String(lc.InvokedFunctionArn),
+		InvocationType: aws.String(lambda.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to continue the copy in a new invocation, %w", err)
+	}
+	log.Printf("continuing the copy in invocation %d, %d blobs uploaded", c.Invocations+1, c.Blobs)
+	return errContinued
+}
+
+// LambdaHandler handles the event like cfn.LambdaWrap, and sends the response to CloudFormation, unless
+// the request continues in a new invocation.
+func LambdaHandler(ctx context.Context, event Event) (reason string, err error) {
+	response := cfn.NewResponse(&event.Event)
+
+	funcDidPanic := true
+	defer func() {
+		if funcDidPanic {
+			response.Status = cfn.StatusFailed
+			response.Reason = "Function panicked, see log stream for details"
+			_ = response.Send()
+		}
+	}()
+
+	progress, err := getContinuation(event.ContinuationToken)
+	if err == nil {
+		response.PhysicalResourceID, response.Data, err = handle(ctx, event.Event, progress)
+	}
+	funcDidPanic = false
+
+	if errors.Is(err, errContinued) {
+		return err.Error(), nil
+	}
+	if err != nil {
+		response.Status = cfn.StatusFailed
+		response.Reason = err.Error()
+		log.Printf("sending status failed: %s", response.Reason)
+	} else {
+		response.Status = cfn.StatusSuccess
+		if response.PhysicalResourceID == "" {
+			log.Println("PhysicalResourceID must exist on creation, copying Log Stream name")
+			response.PhysicalResourceID = lambdacontext.LogStreamName
+		}
+	}
+
+	if err = response.Send(); err != nil {
+		reason = err.Error()
+	}
+	return reason, err
+}
@@ -0,0 +1,267 @@
+package container_image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// fakeLambda records the asynchronous invocations of the provider.
+type fakeLambda struct {
+	lambdaiface.LambdaAPI
+	invocations []*lambda.InvokeInput
+}
+
+func (f *fakeLambda) Invoke(input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+	f.invocations = append(f.invocations, input)
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(http.StatusAccepted)}, nil
+}
+
+// slowRegistry stalls the blob uploads after the allowed number of uploads, until the client gives up.
+type slowRegistry struct {
+	registry http.Handler
+	host     string
+
+	mu      sync.Mutex
+	allowed int
+}
+
+func (s *slowRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/uploads/") {
+		s.mu.Lock()
+		stall := s.allowed == 0
+		if !stall {
+			s.allowed--
+		}
+		s.mu.Unlock()
+		if stall {
+			<-r.Context().Done()
+			return
+		}
+	}
+	s.registry.ServeHTTP(w, r)
+}
+
+func Test_getContinuation(t *testing.T) {
+	progress, err := getContinuation("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.StartTime.IsZero() || progress.Invocations != 0 {
+		t.Errorf("getContinuation() = %+v, want a new continuation", progress)
+	}
+
+	progress.Invocations = 2
+	progress.addBlob()
+	progress.addBlob()
+	token, err := progress.token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := getContinuation(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Invocations != 2 || !got.StartTime.Equal(progress.StartTime) || got.Blobs != 2 {
+		t.Errorf("getContinuation() = %+v, want %+v", got, progress)
+	}
+
+	for _, token := range []string{"not base64!", "bm90IGpzb24="} {
+		if _, err = getContinuation(token); err == nil {
+			t.Errorf("getContinuation(%q) expected an error", token)
+		}
+	}
+}
+
+func Test_continuation_run(t *testing.T) {
+	sourceHost := newTestRegistry(t)
+
+	image, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceReference := mustParse(sourceHost + "/library/python:3.9")
+	if err = remote.Write(sourceReference, image); err != nil {
+		t.Fatal(err)
+	}
+
+	event := cfn.Event{RequestType: cfn.RequestCreate, RequestID: "1", ResourceType: "Custom::ContainerImage"}
+	newTarget := func(t *testing.T) *slowRegistry {
+		target := &slowRegistry{registry: registry.New(registry.Logger(log.New(io.Discard, "", 0)))}
+		target.host = newTestServer(t, target)
+		return target
+	}
+	invocation := func(target *slowRegistry, allowed int, progress *continuation, invoker *fakeLambda) (map[string]interface{}, error) {
+		operation := func(ctx context.Context) (map[string]interface{}, error) {
+			properties := &resourceProperties{Source: sourceReference, Target: mustParse(target.host + "/python:3.9")}
+			return copyImage(ctx, properties, nil, nil, nil, []targetRegistry{&genericTargetRegistry{}}, registryRetryPolicy)
+		}
+		target.mu.Lock()
+		target.allowed = allowed
+		target.mu.Unlock()
+		ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+			InvokedFunctionArn: "arn:aws:lambda:eu-central-1:444093529715:function:cfn-container-image-provider",
+		})
+		ctx, cancel := context.WithTimeout(ctx, continuationReserve+time.Second)
+		defer cancel()
+		return progress.run(ctx, event, invoker, operation)
+	}
+
+	t.Run("no progress", func(t *testing.T) {
+		progress, _ := getContinuation("")
+		invoker := &fakeLambda{}
+		if _, err := invocation(newTarget(t), 0, progress, invoker); err == nil || errors.Is(err, errContinued) || len(invoker.invocations) != 0 {
+			t.Errorf("run() error = %v, invocations %d, want a failure", err, len(invoker.invocations))
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		progress, _ := getContinuation("")
+		progress.StartTime = time.Now().Add(-time.Hour)
+		if _, err := invocation(newTarget(t), 1, progress, &fakeLambda{}); err == nil || errors.Is(err, errContinued) {
+			t.Errorf("run() error = %v, want a failure", err)
+		}
+	})
+
+	t.Run("continued", func(t *testing.T) {
+		target := newTarget(t)
+		progress, _ := getContinuation("")
+		invoker := &fakeLambda{}
+		if _, err := invocation(target, 1, progress, invoker); !errors.Is(err, errContinued) {
+			t.Fatalf("run() error = %v, want %v", err, errContinued)
+		}
+		if len(invoker.invocations) != 1 {
+			t.Fatalf("run() invocations = %d, want 1", len(invoker.invocations))
+		}
+		input := invoker.invocations[0]
+		if aws.StringValue(input.InvocationType) != lambda.InvocationTypeEvent || !strings.HasSuffix(aws.StringValue(input.FunctionName), ":function:cfn-container-image-provider") {
+			t.Errorf("run() invoked %s %s", aws.StringValue(input.InvocationType), aws.StringValue(input.FunctionName))
+		}
+
+		var continued Event
+		if err := json.Unmarshal(input.Payload, &continued); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(continued.Event, event) {
+			t.Errorf("run() continued %+v, want %+v", continued.Event, event)
+		}
+		next, err := getContinuation(continued.ContinuationToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next.Invocations != 1 || next.Blobs != 1 {
+			t.Errorf("run() continuation = %+v, want 1 invocation and 1 blob", next)
+		}
+
+		// the next invocation only uploads the remaining blobs
+		data, err := invocation(target, 3, next, invoker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, _ := image.Digest()
+		if data["Digest"] != digest.String() || next.Blobs != 4 {
+			t.Errorf("run() Digest = %s, blobs %d, want %s and 4 blobs", data["Digest"], next.Blobs, digest)
+		}
+	})
+}
+
+// uncancellableRegistry untags without the context, like ECR, whose BatchDeleteImage takes no context.
+type uncancellableRegistry struct {
+	genericTargetRegistry
+}
+
+func (r *uncancellableRegistry) untag(imageReference name.Reference, digest v1.Hash, _ []remote.Option) deleteOutcome {
+	return r.genericTargetRegistry.untag(imageReference, digest, nil)
+}
+
+func Test_continuation_run_keepsCompletedTargets(t *testing.T) {
+	host := newTestRegistry(t)
+	image, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := mustParse(host + "/library/python:3.9")
+	if err = remote.Write(source, image); err != nil {
+		t.Fatal(err)
+	}
+
+	// the push to the slow target runs out of time, after the push to the other target completed
+	slow := &slowRegistry{registry: registry.New(registry.Logger(log.New(io.Discard, "", 0)))}
+	slow.host = newTestServer(t, slow)
+	completed := mustParse(newTestRegistry(t) + "/eu-central-1/python:3.9")
+	properties := &resourceProperties{
+		Source:       source,
+		Target:       completed,
+		Repositories: []name.Repository{completed.Context(), mustParse(slow.host + "/eu-west-1/python:3.9").Context()},
+	}
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		InvokedFunctionArn: "arn:aws:lambda:eu-central-1:444093529715:function:cfn-container-image-provider",
+	})
+	ctx, cancel := context.WithTimeout(ctx, continuationReserve+time.Second)
+	defer cancel()
+	progress, _ := getContinuation("")
+	_, err = progress.run(ctx, cfn.Event{RequestType: cfn.RequestCreate}, &fakeLambda{}, func(ctx context.Context) (map[string]interface{}, error) {
+		return copyImage(ctx, properties, nil, nil, nil, []targetRegistry{&uncancellableRegistry{}, &uncancellableRegistry{}}, registryRetryPolicy)
+	})
+	if !errors.Is(err, errContinued) {
+		t.Fatalf("run() error = %v, want %v", err, errContinued)
+	}
+	if _, err = remote.Head(completed); err != nil {
+		t.Errorf("run() rolled back the completed target %s, %s", completed, err)
+	}
+}
+
+func Test_LambdaHandler(t *testing.T) {
+	var responses []cfn.Response
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response cfn.Response
+		if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+			t.Error(err)
+		}
+		responses = append(responses, response)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		event      Event
+		wantReason string
+	}{
+		{name: "unsupported resource", event: Event{Event: cfn.Event{RequestType: cfn.RequestCreate, ResourceType: "Custom::Other", ResponseURL: server.URL}},
+			wantReason: "unsupported resource type: Custom::Other"},
+		{name: "invalid token", event: Event{Event: cfn.Event{RequestType: cfn.RequestCreate, ResourceType: "Custom::ContainerImage", ResponseURL: server.URL}, ContinuationToken: "invalid"},
+			wantReason: "invalid ContinuationToken, illegal base64 data at input byte 4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses = nil
+			if _, err := LambdaHandler(context.Background(), tt.event); err != nil {
+				t.Fatal(err)
+			}
+			if len(responses) != 1 || responses[0].Status != cfn.StatusFailed || responses[0].Reason != tt.wantReason {
+				t.Errorf("LambdaHandler() sent %+v, want the reason %q", responses, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package container_image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	reference "github.com/docker/distribution/reference"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// deleteOutcome is logged as a JSON object for every reference a Delete applies to.
+type deleteOutcome struct {
+	PhysicalResourceID string `json:"physicalResourceId"`
+	Reference          string `json:"reference"`
+	Digest             string `json:"digest,omitempty"`
+	Replaced           bool   `json:"replaced"`
+	Outcome            string `json:"outcome"`
+	Reason             string `json:"reason,omitempty"`
+}
+
+const (
+	outcomeDeleted  = "deleted"
+	outcomeRetained = "retained"
+	outcomeIgnored  = "ignored"
+	outcomeFailed   = "failed"
+)
+
+func (o deleteOutcome) log() {
+	if message, err := json.Marshal(o); err == nil {
+		log.Println(string(message))
+	} else {
+		log.Printf("%s %s, %s", o.Outcome, o.Reference, o.Reason)
+	}
+}
+
+const (
+	retainNever        = "false"
+	retainAlways       = "true"
+	retainIfReferenced = "IfReferenced"
+)
+
+// parseRetainOnDelete returns the normalized value of the RetainOnDelete property, which defaults to false.
+func parseRetainOnDelete(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return retainNever, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		for _, retain := range []string{retainNever, retainAlways, retainIfReferenced} {
+			if strings.EqualFold(v, retain) {
+				return retain, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("RetainOnDelete must be true, false or IfReferenced")
+}
+
+// getPhysicalResourceID returns the physical resource id of the image pushed to the target: the
+// target reference pinned to the pushed digest.
+func getPhysicalResourceID(target name.Reference, digest string) string {
+	if _, ok := target.(name.Tag); ok {
+		return fmt.Sprintf("%s@%s", target, digest)
+	}
+	return target.String()
+}
+
+// parsePhysicalResourceID returns the target reference and the pushed digest of the physical resource
+// id. Resources created by previous versions of the provider have no digest in the physical resource id.
+func parsePhysicalResourceID(physicalResourceID string) (target name.Reference, digest string, err error) {
+	named, err := reference.ParseNormalizedNamed(physicalResourceID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if digested, ok := named.(reference.Digested); ok {
+		digest = digested.Digest().String()
+	}
+
+	if tagged, ok := named.(reference.Tagged); ok {
+		target, err = name.NewTag(fmt.Sprintf("%s:%s", named.Name(), tagged.Tag()))
+	} else if digest != "" {
+		target, err = name.NewDigest(fmt.Sprintf("%s@%s", named.Name(), digest))
+	} else {
+		target, err = name.ParseReference(physicalResourceID)
+	}
+	return target, digest, err
+}
+
+// getCurrentPhysicalResourceID returns the physical resource id of the resource in the stack. When an
+// update replaced the resource, it differs from the physical resource id of the Delete of the cleanup.
+func getCurrentPhysicalResourceID(svc cloudformationiface.CloudFormationAPI, event cfn.Event) (string, error) {
+	response, err := svc.DescribeStackResource(&cloudformation.DescribeStackResourceInput{
+		StackName:         aws.String(event.StackID),
+		LogicalResourceId: aws.String(event.LogicalResourceID),
+	})
+	if err != nil {
+		return "", err
+	}
+	if response.StackResourceDetail == nil {
+		return "", fmt.Errorf("no stack resource detail was returned")
+	}
+	return aws.StringValue(response.StackResourceDetail.PhysicalResourceId), nil
+}
+
+// replacement is the resource which replaced the resource of a Delete.
+type replacement struct {
+	target name.Reference
+	digest string
+}
+
+// getReplacement returns the resource which replaced the resource of the Delete, or nil if the resource
+// was not replaced. It returns an error if the current resource in the stack cannot be determined.
+func getReplacement(svc cloudformationiface.CloudFormationAPI, event cfn.Event) (*replacement, error) {
+	if event.StackID == "" || event.LogicalResourceID == "" {
+		return nil, nil
+	}
+
+	currentPhysicalResourceID, err := getCurrentPhysicalResourceID(svc, event)
+	if err != nil {
+		return nil, err
+	}
+	if currentPhysicalResourceID == event.PhysicalResourceID {
+		return nil, nil
+	}
+
+	target, digest, err := parsePhysicalResourceID(currentPhysicalResourceID)
+	if err != nil {
+		return nil, nil
+	}
+	return &replacement{target: target, digest: digest}, nil
+}
+
+func delete(ctx context.Context, event cfn.Event, awsSession client.ConfigProvider) (physicalResourceID string, data map[string]interface{}, err error) {
+	physicalResourceID = event.PhysicalResourceID
+
+	imageReference, digest, err := parsePhysicalResourceID(event.PhysicalResourceID)
+	if err != nil {
+		deleteOutcome{PhysicalResourceID: physicalResourceID, Outcome: outcomeIgnored, Reason: "invalid physical resource id"}.log()
+		return physicalResourceID, nil, nil
+	}
+
+	retainOnDelete, err := parseRetainOnDelete(event.ResourceProperties["RetainOnDelete"])
+	if err != nil {
+		log.Printf("retaining image %s, %s", imageReference, err)
+		retainOnDelete = retainAlways
+	}
+
+	replacedBy, err := getReplacement(cloudformation.New(awsSession), event)
+	if err != nil {
+		if digest == "" {
+			log.Printf("retaining image %s, failed to determine whether it was replaced, %s", imageReference, err)
+			retainOnDelete = retainAlways
+		} else {
+			log.Printf("assuming %s is not replaced, %s", event.PhysicalResourceID, err)
+		}
+	}
+	for _, target := range getDeleteTargets(event, imageReference) {
+		deleteTarget(ctx, event, awsSession, target, digest, replacedBy, retainOnDelete)
+	}
+	return physicalResourceID, nil, nil
+}
+
+// getDeleteTargets returns the reference of the image in every target repository of the resource.
+func getDeleteTargets(event cfn.Event, imageReference name.Reference) []name.Reference {
+	result := []name.Reference{imageReference}
+	fips, _ := getBool(event.ResourceProperties["UseFIPSEndpoint"])
+	arns, _ := getStringList(event.ResourceProperties["RepositoryArns"])
+	for _, arn := range arns {
+		repository, err := getECRRepository(arn, fips)
+		if err != nil {
+			log.Printf("ignoring repository %s, %s", arn, err)
+			continue
+		}
+		if target := retarget(imageReference, repository); target.String() != imageReference.String() {
+			result = append(result, target)
+		}
+	}
+	return result
+}
+
+// deleteTarget deletes the image and its tags from a target repository, and logs the outcome.
+func deleteTarget(ctx context.Context, event cfn.Event, awsSession client.ConfigProvider, imageReference name.Reference, digest string, replacedBy *replacement, retainOnDelete string) {
+	secretArn, _ := event.ResourceProperties["TargetCredentialsSecretArn"].(string)
+	roleArn, _ := event.ResourceProperties["TargetRoleArn"].(string)
+	registry := newTargetRegistry(awsSession, imageReference, secretArn, roleArn)
+	authenticator, err := registry.authenticator()
+	if err != nil {
+		deleteOutcome{PhysicalResourceID: event.PhysicalResourceID, Reference: imageReference.String(), Outcome: outcomeFailed, Reason: err.Error()}.log()
+		return
+	}
+
+	deleteOptions := []remote.Option{
+		remote.WithAuth(authenticator),
+		remote.WithContext(ctx),
+	}
+
+	references := []name.Reference{imageReference}
+	for _, tag := range getAdditionalTags(event, imageReference, deleteOptions) {
+		if tagReference := imageReference.Context().Tag(tag); tagReference.String() != imageReference.String() {
+			references = append(references, tagReference)
+		}
+	}
+
+	deletion := &deletion{
+		digest:         digest,
+		replacedBy:     replacedBy,
+		retainOnDelete: retainOnDelete,
+		references:     references,
+		options:        deleteOptions,
+		registry:       registry,
+	}
+	for _, reference := range references {
+		outcome := deletion.deleteReference(reference)
+		outcome.PhysicalResourceID = event.PhysicalResourceID
+		outcome.Reference = reference.String()
+		outcome.Digest = digest
+		outcome.Replaced = deletion.replacedBy != nil
+		outcome.log()
+	}
+
+	ecrTarget, isECR := registry.(*ecrTargetRegistry)
+	if createRepository, _ := getBool(event.ResourceProperties["CreateRepository"]); createRepository && isECR && retainOnDelete != retainAlways {
+		outcome := deleteRepository(ecrTarget.svc, ecrTarget.registryID, imageReference.Context().RepositoryStr(), getCreatedBy(event))
+		outcome.PhysicalResourceID = event.PhysicalResourceID
+		outcome.Reference = imageReference.Context().String()
+		outcome.Replaced = deletion.replacedBy != nil
+		outcome.log()
+	}
+}
+
+// deletion deletes the references of a resource.
+type deletion struct {
+	// digest is the pushed digest, which is unknown for resources created by previous versions
+	digest         string
+	replacedBy     *replacement
+	retainOnDelete string
+	references     []name.Reference
+	options        []remote.Option
+	registry       targetRegistry
+}
+
+// deleteReference deletes the reference if it still points to the pushed digest. A reference in use by the
+// replacement of the resource is retained, as the replacement may have pushed the same image.
+func (d *deletion) deleteReference(imageReference name.Reference) deleteOutcome {
+	if d.retainOnDelete == retainAlways {
+		return deleteOutcome{Outcome: outcomeRetained, Reason: "RetainOnDelete is true"}
+	}
+
+	descriptor, err := remote.Head(imageReference, d.options...)
+	if err != nil {
+		return deleteOutcome{Outcome: outcomeIgnored, Reason: fmt.Sprintf("image not found, %s", err)}
+	}
+
+	if d.digest != "" && descriptor.Digest.String() != d.digest {
+		return deleteOutcome{Outcome: outcomeRetained, Reason: fmt.Sprintf("the image now points to %s", descriptor.Digest)}
+	}
+
+	if d.replacedBy != nil {
+		if d.replacedBy.digest == descriptor.Digest.String() || d.replacedBy.target.String() == imageReference.String() {
+			return deleteOutcome{Outcome: outcomeRetained, Reason: fmt.Sprintf("the image is in use by %s", d.replacedBy.target)}
+		}
+	}
+
+	// ECR only removes the tag, and leaves the image to the other tags. A digest reference, or a tag in
+	// another registry, may remove the image itself.
+	_, isTag := imageReference.(name.Tag)
+	_, isECR := d.registry.(*ecrTargetRegistry)
+	if d.retainOnDelete == retainIfReferenced && !(isTag && isECR) {
+		tags, err := d.getOtherTags(imageReference.Context(), descriptor.Digest)
+		if err != nil {
+			return deleteOutcome{Outcome: outcomeRetained, Reason: fmt.Sprintf("failed to list the tags of the repository, %s", err)}
+		}
+		if len(tags) > 0 {
+			return deleteOutcome{Outcome: outcomeRetained, Reason: fmt.Sprintf("the image is referenced by the tags %s", strings.Join(tags, ", "))}
+		}
+	}
+
+	return d.registry.untag(imageReference, descriptor.Digest, d.options)
+}
+
+// getOtherTags returns the tags in the repository which point to the digest, other than the references of
+// the resource.
+func (d *deletion) getOtherTags(repository name.Repository, digest v1.Hash) ([]string, error) {
+	tags, err := d.registry.tags(repository, digest, d.options)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if !d.isReference(repository.Tag(tag)) {
+			result = append(result, tag)
+		}
+	}
+	return result, nil
+}
+
+func (d *deletion) isReference(imageReference name.Reference) bool {
+	for _, reference := range d.references {
+		if reference.String() == imageReference.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// getAdditionalTags returns the additional tags of the image. Tag templates are expanded against the
+// image in the repository, as the source image may have changed since it was pushed.
+func getAdditionalTags(event cfn.Event, imageReference name.Reference, options []remote.Option) []string {
+	tags, ok := getStringList(event.ResourceProperties["AdditionalTags"])
+	if !ok {
+		return nil
+	}
+
+	properties, err := validate(event, nil)
+	if err != nil {
+		log.Printf("ignoring additional tags of image %s, %s", imageReference, err)
+		return nil
+	}
+	if !properties.hasTagTemplates() {
+		return tags
+	}
+
+	descriptor, err := remote.Get(imageReference, options...)
+	if err != nil {
+		log.Printf("ignoring additional tag templates of image %s, %s", imageReference, err)
+		return nil
+	}
+
+	templateData, err := getTagTemplateData(properties, descriptor, descriptor)
+	if err == nil {
+		err = properties.expandTags(templateData)
+	}
+	if err != nil {
+		log.Printf("ignoring additional tag templates of image %s, %s", imageReference, err)
+		return nil
+	}
+	return properties.AdditionalTags
+}
@@ -0,0 +1,363 @@
+package container_image
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func Test_parsePhysicalResourceID(t *testing.T) {
+	const digest = "sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659"
+	tests := []struct {
+		name               string
+		physicalResourceID string
+		wantTarget         string
+		wantDigest         string
+		wantErr            bool
+	}{
+		{
+			name:               "tag and digest",
+			physicalResourceID: "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9@" + digest,
+			wantTarget:         "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9",
+			wantDigest:         digest,
+		},
+		{
+			name:               "digest",
+			physicalResourceID: "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python@" + digest,
+			wantTarget:         "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python@" + digest,
+			wantDigest:         digest,
+		},
+		{
+			name:               "previous version",
+			physicalResourceID: "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9",
+			wantTarget:         "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9",
+		},
+		{
+			name:               "create failed",
+			physicalResourceID: "create-failed",
+			wantTarget:         "index.docker.io/library/create-failed:latest",
+		},
+		{
+			name:               "invalid",
+			physicalResourceID: "https://444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9",
+			wantErr:            true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, digest, err := parsePhysicalResourceID(tt.physicalResourceID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePhysicalResourceID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if target.Name() != tt.wantTarget {
+				t.Errorf("parsePhysicalResourceID() target = %s, want %s", target.Name(), tt.wantTarget)
+			}
+			if digest != tt.wantDigest {
+				t.Errorf("parsePhysicalResourceID() digest = %s, want %s", digest, tt.wantDigest)
+			}
+			if tt.wantDigest != "" && getPhysicalResourceID(target, digest) != tt.physicalResourceID {
+				t.Errorf("getPhysicalResourceID() = %s, want %s", getPhysicalResourceID(target, digest), tt.physicalResourceID)
+			}
+		})
+	}
+}
+
+type fakeCloudFormation struct {
+	cloudformationiface.CloudFormationAPI
+	physicalResourceIDs map[string]string
+}
+
+func (f *fakeCloudFormation) DescribeStackResource(input *cloudformation.DescribeStackResourceInput) (*cloudformation.DescribeStackResourceOutput, error) {
+	if physicalResourceID, ok := f.physicalResourceIDs[aws.StringValue(input.LogicalResourceId)]; ok {
+		return &cloudformation.DescribeStackResourceOutput{
+			StackResourceDetail: &cloudformation.StackResourceDetail{
+				LogicalResourceId:  input.LogicalResourceId,
+				PhysicalResourceId: aws.String(physicalResourceID),
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("ValidationError: Resource %s does not exist", aws.StringValue(input.LogicalResourceId))
+}
+
+func Test_getReplacement(t *testing.T) {
+	const digest = "sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659"
+	svc := &fakeCloudFormation{physicalResourceIDs: map[string]string{
+		"Current":  "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9",
+		"Replaced": "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9@" + digest,
+	}}
+	event := cfn.Event{
+		StackID:            "arn:aws:cloudformation:eu-central-1:444093529715:stack/demo/a2b2f800-0000-11ee-0000-000000000000",
+		PhysicalResourceID: "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9",
+	}
+
+	event.LogicalResourceID = "Current"
+	if got, err := getReplacement(svc, event); got != nil || err != nil {
+		t.Errorf("getReplacement() = %v, %v, want nil", got, err)
+	}
+
+	event.LogicalResourceID = "Missing"
+	if got, err := getReplacement(svc, event); got != nil || err == nil {
+		t.Errorf("getReplacement() = %v, %v, want an error", got, err)
+	}
+
+	event.LogicalResourceID = "Replaced"
+	got, err := getReplacement(svc, event)
+	if err != nil || got == nil || got.digest != digest || got.target.String() != event.PhysicalResourceID {
+		t.Errorf("getReplacement() = %v, %v, want %s@%s", got, err, event.PhysicalResourceID, digest)
+	}
+}
+
+// fakeRegistryECR removes images from a local registry, the way ECR does.
+type fakeRegistryECR struct {
+	ecriface.ECRAPI
+	host        string
+	failureCode string
+}
+
+func (f *fakeRegistryECR) BatchDeleteImage(input *ecr.BatchDeleteImageInput) (*ecr.BatchDeleteImageOutput, error) {
+	result := &ecr.BatchDeleteImageOutput{}
+	for _, imageID := range input.ImageIds {
+		if f.failureCode != "" {
+			result.Failures = append(result.Failures, &ecr.ImageFailure{FailureCode: aws.String(f.failureCode), ImageId: imageID})
+			continue
+		}
+
+		var imageReference name.Reference = mustParse(f.host + "/" + aws.StringValue(input.RepositoryName) + "@" + aws.StringValue(imageID.ImageDigest))
+		if imageID.ImageTag != nil {
+			imageReference = mustParse(f.host + "/" + aws.StringValue(input.RepositoryName) + ":" + aws.StringValue(imageID.ImageTag))
+		}
+		descriptor, err := remote.Head(imageReference)
+		if err != nil {
+			result.Failures = append(result.Failures, &ecr.ImageFailure{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound), ImageId: imageID})
+			continue
+		}
+		if descriptor.Digest.String() != aws.StringValue(imageID.ImageDigest) {
+			result.Failures = append(result.Failures, &ecr.ImageFailure{FailureCode: aws.String(ecr.ImageFailureCodeImageTagDoesNotMatchDigest), ImageId: imageID})
+			continue
+		}
+		if err = remote.Delete(imageReference); err != nil {
+			return nil, err
+		}
+		result.ImageIds = append(result.ImageIds, imageID)
+	}
+	return result, nil
+}
+
+func (f *fakeRegistryECR) ListImagesPages(input *ecr.ListImagesInput, fn func(*ecr.ListImagesOutput, bool) bool) error {
+	repository, err := name.NewRepository(f.host + "/" + aws.StringValue(input.RepositoryName))
+	if err != nil {
+		return err
+	}
+	tags, err := remote.List(repository)
+	if err != nil {
+		return err
+	}
+
+	result := &ecr.ListImagesOutput{}
+	for _, tag := range tags {
+		descriptor, err := remote.Head(repository.Tag(tag))
+		if err != nil {
+			return err
+		}
+		result.ImageIds = append(result.ImageIds, &ecr.ImageIdentifier{ImageTag: aws.String(tag), ImageDigest: aws.String(descriptor.Digest.String())})
+	}
+	fn(result, true)
+	return nil
+}
+
+func Test_deleteReference(t *testing.T) {
+	host := newTestRegistry(t)
+
+	pushed, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushedDigest, _ := pushed.Digest()
+	other, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDigest, _ := other.Digest()
+
+	tests := []struct {
+		name           string
+		image          v1.Image
+		digest         string
+		replacedBy     *replacement
+		retainOnDelete string
+		otherTag       v1.Image
+		failureCode    string
+		generic        bool
+		byDigest       bool
+		wantOutcome    string
+	}{
+		{name: "pushed digest", image: pushed, digest: pushedDigest.String(), wantOutcome: outcomeDeleted},
+		{name: "re-pointed tag", image: other, digest: pushedDigest.String(), wantOutcome: outcomeRetained},
+		{name: "not found", digest: pushedDigest.String(), wantOutcome: outcomeIgnored},
+		{name: "previous version", image: pushed, wantOutcome: outcomeDeleted},
+		{
+			name:        "previous version replaced by another tag",
+			image:       pushed,
+			replacedBy:  &replacement{target: mustParse(host + "/mirror/python:3.10"), digest: otherDigest.String()},
+			wantOutcome: outcomeDeleted,
+		},
+		{
+			name:        "previous version replaced by the same image",
+			image:       other,
+			replacedBy:  &replacement{target: mustParse(host + "/mirror/python:3.10"), digest: otherDigest.String()},
+			wantOutcome: outcomeRetained,
+		},
+		{
+			name:        "previous version replaced by the same tag",
+			image:       pushed,
+			replacedBy:  &replacement{target: mustParse(host + "/mirror/python:test")},
+			wantOutcome: outcomeRetained,
+		},
+		{
+			name:        "tag shared with the replacement",
+			image:       pushed,
+			digest:      pushedDigest.String(),
+			replacedBy:  &replacement{target: mustParse(host + "/mirror/python:3.9.18"), digest: pushedDigest.String()},
+			wantOutcome: outcomeRetained,
+		},
+		{
+			name:        "tag not shared with the replacement",
+			image:       pushed,
+			digest:      pushedDigest.String(),
+			replacedBy:  &replacement{target: mustParse(host + "/mirror/python:3.10"), digest: otherDigest.String()},
+			wantOutcome: outcomeDeleted,
+		},
+		{name: "retain", image: pushed, digest: pushedDigest.String(), retainOnDelete: retainAlways, wantOutcome: outcomeRetained},
+		{name: "retain not found", digest: pushedDigest.String(), retainOnDelete: retainAlways, wantOutcome: outcomeRetained},
+		{name: "if referenced without other tags", image: pushed, digest: pushedDigest.String(), retainOnDelete: retainIfReferenced, wantOutcome: outcomeDeleted},
+		{
+			name:           "if referenced by another tag",
+			image:          pushed,
+			digest:         pushedDigest.String(),
+			retainOnDelete: retainIfReferenced,
+			otherTag:       pushed,
+			wantOutcome:    outcomeDeleted,
+		},
+		{
+			name:           "digest if referenced by another tag",
+			image:          pushed,
+			digest:         pushedDigest.String(),
+			retainOnDelete: retainIfReferenced,
+			otherTag:       pushed,
+			byDigest:       true,
+			wantOutcome:    outcomeRetained,
+		},
+		{
+			name:           "digest if referenced without other tags",
+			image:          pushed,
+			digest:         pushedDigest.String(),
+			retainOnDelete: retainIfReferenced,
+			byDigest:       true,
+			wantOutcome:    outcomeDeleted,
+		},
+		{
+			name:           "generic registry if referenced by another tag",
+			image:          pushed,
+			digest:         pushedDigest.String(),
+			retainOnDelete: retainIfReferenced,
+			otherTag:       pushed,
+			generic:        true,
+			wantOutcome:    outcomeRetained,
+		},
+		{
+			name:           "if referenced by another tag with another image",
+			image:          pushed,
+			digest:         pushedDigest.String(),
+			retainOnDelete: retainIfReferenced,
+			otherTag:       other,
+			wantOutcome:    outcomeDeleted,
+		},
+		{name: "untag only", image: pushed, digest: pushedDigest.String(), otherTag: pushed, wantOutcome: outcomeDeleted},
+		{
+			name:        "tag moved while deleting",
+			image:       pushed,
+			digest:      pushedDigest.String(),
+			failureCode: ecr.ImageFailureCodeImageTagDoesNotMatchDigest,
+			wantOutcome: outcomeRetained,
+		},
+		{name: "generic registry", image: pushed, digest: pushedDigest.String(), generic: true, wantOutcome: outcomeDeleted},
+		{name: "generic registry re-pointed tag", image: other, digest: pushedDigest.String(), generic: true, wantOutcome: outcomeRetained},
+		{
+			name:        "generic registry tag shared with the replacement",
+			image:       pushed,
+			digest:      pushedDigest.String(),
+			replacedBy:  &replacement{target: mustParse(host + "/mirror/python:3.9.18"), digest: pushedDigest.String()},
+			generic:     true,
+			wantOutcome: outcomeRetained,
+		},
+		{
+			name:        "generic registry previous version replaced by the same image",
+			image:       pushed,
+			replacedBy:  &replacement{target: mustParse(host + "/mirror/python:3.9.18"), digest: pushedDigest.String()},
+			generic:     true,
+			wantOutcome: outcomeRetained,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reference := mustParse(host + "/mirror/python:test")
+			otherReference := mustParse(host + "/mirror/python:other")
+			for _, r := range []name.Reference{reference, otherReference} {
+				if err := remote.Delete(r); err != nil {
+					t.Logf("no image to delete, %s", err)
+				}
+			}
+			if tt.byDigest {
+				reference = mustParse(host + "/mirror/python@" + tt.digest)
+			}
+			if tt.image != nil {
+				if err := remote.Write(reference, tt.image); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.otherTag != nil {
+				if err := remote.Write(otherReference, tt.otherTag); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d := &deletion{
+				digest:         tt.digest,
+				replacedBy:     tt.replacedBy,
+				retainOnDelete: tt.retainOnDelete,
+				references:     []name.Reference{reference},
+				registry:       &ecrTargetRegistry{svc: &fakeRegistryECR{host: host, failureCode: tt.failureCode}},
+			}
+			if tt.generic {
+				d.registry = &genericTargetRegistry{}
+			}
+			got := d.deleteReference(reference)
+			if got.Outcome != tt.wantOutcome {
+				t.Errorf("deleteReference() = %v, want outcome %s", got, tt.wantOutcome)
+			}
+
+			_, err := remote.Head(reference)
+			if exists := err == nil; exists != (tt.image != nil && tt.wantOutcome != outcomeDeleted) {
+				t.Errorf("deleteReference() image exists = %v after outcome %s", exists, got.Outcome)
+			}
+			if tt.otherTag != nil {
+				if _, err := remote.Head(otherReference); err != nil {
+					t.Errorf("deleteReference() removed the other tag, %s", err)
+				}
+			}
+		})
+	}
+}
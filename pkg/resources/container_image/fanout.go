@@ -0,0 +1,159 @@
+package container_image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// getTargets returns the reference of the image in every target repository. Without RepositoryArns, this
+// is the Target.
+func (p *resourceProperties) getTargets() []name.Reference {
+	if len(p.Repositories) == 0 {
+		return []name.Reference{p.Target}
+	}
+
+	result := make([]name.Reference, 0, len(p.Repositories))
+	for _, repository := range p.Repositories {
+		result = append(result, retarget(p.Target, repository))
+	}
+	return result
+}
+
+// getTargetStrings returns the references of the image in every target repository as strings.
+func (p *resourceProperties) getTargetStrings() []string {
+	result := make([]string, 0, len(p.Repositories)+1)
+	for _, target := range p.getTargets() {
+		result = append(result, target.String())
+	}
+	return result
+}
+
+// retarget returns the reference with the same tag or digest in another repository.
+func retarget(reference name.Reference, repository name.Repository) name.Reference {
+	if tag, ok := reference.(name.Tag); ok {
+		return repository.Tag(tag.TagStr())
+	}
+	return repository.Digest(reference.Identifier())
+}
+
+// withTarget returns a copy of the properties with the target and its ECR repository.
+func (p *resourceProperties) withTarget(target name.Reference) *resourceProperties {
+	result := *p
+	result.Target = target
+	if registry, ok := parseECRRegistry(target.Context().RegistryStr()); ok {
+		result.AccountID = registry.accountID
+		result.Region = registry.region
+		result.RepositoryName = target.Context().RepositoryStr()
+	}
+	return &result
+}
+
+// getTargetRegistries returns the registry of every target.
+func getTargetRegistries(awsSession client.ConfigProvider, properties *resourceProperties) []targetRegistry {
+	result := make([]targetRegistry, 0, len(properties.Repositories)+1)
+	for _, target := range properties.getTargets() {
+		result = append(result, newTargetRegistry(awsSession, target, properties.TargetCredentialsSecretArn, properties.TargetRoleArn))
+	}
+	return result
+}
+
+// pushImageToTargets pushes the image to every target concurrently, and returns the resource attributes.
+// Only the references which do not point to the image yet are pushed. If the signer is not nil, the image
+// is signed. If the push to a target fails, the references which did not point to the image before the
+// push are removed from every target, unless RetainOnDelete is true. A push which ran out of time is not
+// rolled back, as the request continues in a new invocation with the targets that were completed.
+func pushImageToTargets(ctx context.Context, properties *resourceProperties, image *sourceImage, signer signer, registries []targetRegistry, policy retryPolicy) (map[string]interface{}, error) {
+	targets := properties.getTargets()
+	authenticators := make([]authn.Authenticator, len(targets))
+	results := make([]map[string]interface{}, len(targets))
+	existing := make([]map[string]bool, len(targets))
+	errs := make([]error, len(targets))
+
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if authenticators[i], errs[i] = registries[i].authenticator(); errs[i] != nil {
+				errs[i] = fmt.Errorf("failed to get authorization token for %s: %w", targets[i].Context().RegistryStr(), errs[i])
+				return
+			}
+			existing[i] = getExistingReferences(ctx, properties.withTarget(targets[i]), image, authenticators[i])
+			if results[i], errs[i] = pushImage(ctx, properties.withTarget(targets[i]), image, authenticators[i], existing[i], policy); errs[i] == nil && signer != nil {
+				results[i]["SignatureDigest"], errs[i] = signTarget(ctx, targets[i], image, signer, authenticators[i])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		if properties.RetainOnDelete == retainAlways || ctx.Err() != nil {
+			return nil, err
+		}
+		for i, authenticator := range authenticators {
+			if authenticator != nil {
+				rollbackImage(ctx, properties.withTarget(targets[i]), image, registries[i], authenticators[i], existing[i])
+			}
+		}
+		return nil, err
+	}
+	return results[0], nil
+}
+
+// getReferences returns the Target and the references of the tags.
+func (p *resourceProperties) getReferences() []name.Reference {
+	result := []name.Reference{p.Target}
+	for _, tag := range p.getTags() {
+		if tagReference := p.Target.Context().Tag(tag); tagReference.String() != p.Target.String() {
+			result = append(result, tagReference)
+		}
+	}
+	return result
+}
+
+// getExistingReferences returns the references of a target which already point to the image.
+func getExistingReferences(ctx context.Context, properties *resourceProperties, image *sourceImage, authenticator authn.Authenticator) map[string]bool {
+	options := []remote.Option{
+		remote.WithAuth(authenticator),
+		remote.WithContext(ctx),
+	}
+
+	result := make(map[string]bool)
+	for _, reference := range properties.getReferences() {
+		if descriptor, err := remote.Head(reference, options...); err == nil && descriptor.Digest == image.digest {
+			result[reference.String()] = true
+		}
+	}
+	return result
+}
+
+// rollbackImage removes the Target and the tags of an image pushed to a target, except for the existing
+// references which pointed to the image before the push.
+func rollbackImage(ctx context.Context, properties *resourceProperties, image *sourceImage, registry targetRegistry, authenticator authn.Authenticator, existing map[string]bool) {
+	options := []remote.Option{
+		remote.WithAuth(authenticator),
+		remote.WithContext(ctx),
+	}
+
+	for _, reference := range properties.getReferences() {
+		if existing[reference.String()] {
+			continue
+		}
+		outcome := registry.untag(reference, image.digest, options)
+		outcome.Reference = reference.String()
+		outcome.Digest = image.digest.String()
+		if outcome.Reason == "" {
+			outcome.Reason = "rollback"
+		} else {
+			outcome.Reason = fmt.Sprintf("rollback, %s", outcome.Reason)
+		}
+		outcome.log()
+	}
+}
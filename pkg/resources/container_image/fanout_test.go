@@ -0,0 +1,166 @@
+package container_image
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func Test_getTargets(t *testing.T) {
+	properties := &resourceProperties{
+		Target: mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+		Repositories: []name.Repository{
+			mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9").Context(),
+			mustParse("444093529715.dkr.ecr.eu-west-1.amazonaws.com/mirror/python:3.9").Context(),
+		},
+	}
+	want := []string{
+		"444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9",
+		"444093529715.dkr.ecr.eu-west-1.amazonaws.com/mirror/python:3.9",
+	}
+	if got := properties.getTargetStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("getTargetStrings() = %v, want %v", got, want)
+	}
+
+	target := properties.withTarget(properties.getTargets()[1])
+	if target.Region != "eu-west-1" || target.AccountID != "444093529715" || target.RepositoryName != "mirror/python" {
+		t.Errorf("withTarget() = %s %s %s, want eu-west-1 444093529715 mirror/python", target.Region, target.AccountID, target.RepositoryName)
+	}
+
+	properties.Target = mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659")
+	if got := properties.getTargets()[1].String(); got != "444093529715.dkr.ecr.eu-west-1.amazonaws.com/mirror/python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659" {
+		t.Errorf("getTargets() = %s, want the digest in the other repository", got)
+	}
+}
+
+func Test_getDeleteTargets(t *testing.T) {
+	event := cfn.Event{
+		ResourceProperties: map[string]interface{}{
+			"RepositoryArns": []interface{}{
+				"arn:aws:ecr:eu-central-1:444093529715:repository/python",
+				"arn:aws:ecr:eu-west-1:444093529715:repository/python",
+			},
+		},
+	}
+	got := getDeleteTargets(event, mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"))
+	if len(got) != 2 || got[1].String() != "444093529715.dkr.ecr.eu-west-1.amazonaws.com/python:3.9" {
+		t.Errorf("getDeleteTargets() = %v, want both repositories", got)
+	}
+}
+
+func Test_deleteReference_reorderedRepositories(t *testing.T) {
+	host := newTestRegistry(t)
+
+	image, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := image.Digest()
+	targets := []name.Reference{mustParse(host + "/eu-central-1/python:3.9"), mustParse(host + "/eu-west-1/python:3.9")}
+	for _, target := range targets {
+		if err = remote.Write(target, image); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reordering the repositories changes the physical resource id to the other target, which replaces the
+	// resource with the same image
+	replacedBy := &replacement{target: targets[1], digest: digest.String()}
+	for _, target := range targets {
+		d := &deletion{
+			digest:     digest.String(),
+			replacedBy: replacedBy,
+			references: []name.Reference{target},
+			registry:   &genericTargetRegistry{},
+		}
+		if got := d.deleteReference(target); got.Outcome != outcomeRetained {
+			t.Errorf("deleteReference(%s) = %v, want outcome %s", target, got, outcomeRetained)
+		}
+		if _, err := remote.Head(target); err != nil {
+			t.Errorf("deleteReference() removed %s of the replacement, %s", target, err)
+		}
+	}
+}
+
+func Test_pushImageToTargets(t *testing.T) {
+	host := newTestRegistry(t)
+
+	// a registry which is no longer listening
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	unavailableHost := strings.TrimPrefix(unavailable.URL, "http://")
+	unavailable.Close()
+
+	source := mustParse(host + "/library/python:3.9")
+	if err := remote.WriteIndex(source, mustMultiPlatformIndex(t, "linux/amd64", "linux/arm64")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		repositories   []string
+		pushedBefore   bool
+		retainOnDelete string
+		wantErr        bool
+		wantRetained   bool
+	}{
+		{name: "all targets", repositories: []string{host + "/eu-central-1/python", host + "/eu-west-1/python"}},
+		{name: "rollback", repositories: []string{host + "/us-east-1/python", unavailableHost + "/us-west-2/python"}, wantErr: true},
+		{name: "rollback retains existing references", repositories: []string{host + "/ap-south-1/python", unavailableHost + "/us-west-2/python"},
+			pushedBefore: true, wantErr: true, wantRetained: true},
+		{name: "rollback with RetainOnDelete", repositories: []string{host + "/ap-east-1/python", unavailableHost + "/us-west-2/python"},
+			retainOnDelete: retainAlways, wantErr: true, wantRetained: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			properties := &resourceProperties{
+				Source:         source,
+				Target:         mustParse(tt.repositories[0] + ":3.9"),
+				Platform:       mustParsePlatform("linux/arm64"),
+				AdditionalTags: []string{"stable"},
+				RetainOnDelete: tt.retainOnDelete,
+			}
+			registries := make([]targetRegistry, 0, len(tt.repositories))
+			for _, repository := range tt.repositories {
+				properties.Repositories = append(properties.Repositories, mustParse(repository).Context())
+				registries = append(registries, &genericTargetRegistry{})
+			}
+			if tt.pushedBefore {
+				before := *properties
+				before.Repositories = properties.Repositories[:1]
+				if _, err := copyImage(context.Background(), &before, nil, nil, nil, registries[:1], registryRetryPolicy); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			data, err := copyImage(context.Background(), properties, nil, nil, nil, registries, registryRetryPolicy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("copyImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(data["ImageReferences"], properties.getTargetStrings()) {
+				t.Errorf("copyImage() ImageReferences = %v, want %v", data["ImageReferences"], properties.getTargetStrings())
+			}
+
+			// the push to the unavailable registry fails, and the other targets are rolled back
+			repositories := tt.repositories
+			if tt.wantErr {
+				repositories = repositories[:1]
+			}
+			for _, repository := range repositories {
+				for _, tag := range []string{"3.9", "stable"} {
+					_, err := remote.Head(mustParse(repository + ":" + tag))
+					if exists := err == nil; exists != (!tt.wantErr || tt.wantRetained) {
+						t.Errorf("copyImage() %s:%s exists = %v", repository, tag, exists)
+					}
+				}
+			}
+		})
+	}
+}
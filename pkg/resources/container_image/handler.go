@@ -3,6 +3,8 @@ package container_image
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -12,8 +14,16 @@ import (
 	"github.com/google/go-containerregistry/pkg/logs"
 
 	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
 	reference "github.com/docker/distribution/reference"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
@@ -27,16 +37,42 @@ type resourceProperties struct {
 	SourceDigest   string
 	SourceName     string
 	Platform       *v1.Platform
+	Platforms      []v1.Platform
 	Target         name.Reference
 	Region         string
 	AccountID      string
 	RepositoryName string
+
+	SourceCredentialsSecretArn string
+	SourceRoleArn              string
+	SourceRegion               string
+	SourceAccountID            string
+	TargetRoleArn              string
+	TargetCredentialsSecretArn string
+	TargetTag                  string
+	AdditionalTags             []string
+	RetainOnDelete             string
+	CreateRepository           *repositoryConfiguration
+	Repositories               []name.Repository
+	UseFIPSEndpoint            bool
+	VerifySignature            *signatureVerification
+	CopyReferrers              bool
+	SignWith                   string
+	Mirror                     name.Reference
+	MirrorFallback             bool
 }
 
-// The name must start with a letter and can only contain lowercase letters, numbers, hyphens, underscores, periods and forward slashes.
-var ecrRepositoryArnPattern = regexp.MustCompile(`^arn:aws:ecr:([a-z\d-]+):(\d+):repository/([a-z][a-z\d-_/.]+)$`)
+// The repository name is validated by validateRepositoryName.
+var ecrRepositoryArnPattern = regexp.MustCompile(`^arn:([a-z-]+):ecr:([a-z\d-]+):(\d+):repository/(.+)$`)
+
+var tagPattern = regexp.MustCompile(`^` + reference.TagRegexp.String() + `$`)
 
-func validate(event cfn.Event) (*resourceProperties, error) {
+var stackIDPattern = regexp.MustCompile(`^arn:([a-z-]+):cloudformation:([a-z\d-]+):(\d{12}):stack/`)
+
+// validate returns the properties of the request, or an error naming the invalid property or the violated
+// rule of the provider policy. A delete passes no policy, so a resource which violates a changed policy
+// can still be deleted.
+func validate(event cfn.Event, providerPolicy *policy) (*resourceProperties, error) {
 	var err error
 	var imageReference reference.Reference
 	result := new(resourceProperties)
@@ -85,39 +121,125 @@ func validate(event cfn.Event) (*resourceProperties, error) {
 		}
 	}
 
-	if arn, ok := event.ResourceProperties["RepositoryArn"].(string); ok {
-		matches := ecrRepositoryArnPattern.FindStringSubmatch(arn)
-		if len(matches) != 4 {
-			return nil, fmt.Errorf("Invalid AWS ECR repository ARN: %s", arn)
+	if targetTag, ok := event.ResourceProperties["TargetTag"]; ok {
+		if result.TargetTag, ok = targetTag.(string); !ok {
+			return nil, fmt.Errorf("TargetTag is not a string")
 		}
+		if err = validateTag(result.TargetTag); err != nil {
+			return nil, fmt.Errorf("invalid TargetTag, %s", err)
+		}
+	}
 
-		result.Region = matches[1]
-		result.AccountID = matches[2]
-		result.RepositoryName = matches[3]
+	if additionalTags, ok := event.ResourceProperties["AdditionalTags"]; ok {
+		if result.AdditionalTags, ok = getStringList(additionalTags); !ok {
+			return nil, fmt.Errorf("AdditionalTags is not a list of strings")
+		}
+		for _, tag := range result.AdditionalTags {
+			if err = validateTag(tag); err != nil {
+				return nil, fmt.Errorf("invalid AdditionalTags, %s", err)
+			}
+		}
+	}
 
-		var reference string
-		if result.SourceTag != "" {
-			reference = fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s:%s",
-				result.AccountID,
-				result.Region,
-				result.RepositoryName,
-				result.SourceTag)
-		} else {
-			reference = fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s@%s",
-				result.AccountID,
-				result.Region,
-				result.RepositoryName,
-				result.SourceDigest)
+	if fips, ok := event.ResourceProperties["UseFIPSEndpoint"]; ok {
+		if result.UseFIPSEndpoint, ok = getBool(fips); !ok {
+			return nil, fmt.Errorf("UseFIPSEndpoint is not a boolean")
 		}
+	}
 
-		if result.Target, err = name.ParseReference(reference); err != nil {
+	arn, ok := event.ResourceProperties["RepositoryArn"].(string)
+	if repositoryUri, hasUri := event.ResourceProperties["RepositoryUri"]; hasUri {
+		if _, hasArn := event.ResourceProperties["RepositoryArn"]; hasArn {
+			return nil, fmt.Errorf("RepositoryUri is mutually exclusive with RepositoryArn")
+		}
+		if arn, err = parseRepositoryUri(repositoryUri, result); err != nil {
 			return nil, err
 		}
+		ok = true
+	}
+
+	if repositoryName, hasName := event.ResourceProperties["RepositoryName"]; hasName {
+		if ok {
+			return nil, fmt.Errorf("RepositoryName is mutually exclusive with RepositoryArn and RepositoryUri")
+		}
+		if arn, ok = repositoryName.(string); !ok || arn == "" {
+			return nil, fmt.Errorf("RepositoryName is not a string")
+		}
+		matches := stackIDPattern.FindStringSubmatch(event.StackID)
+		if len(matches) != 4 {
+			return nil, fmt.Errorf("RepositoryName requires the account and region of the stack, %q", event.StackID)
+		}
+		arn = fmt.Sprintf("arn:%s:ecr:%s:%s:repository/%s", matches[1], matches[2], matches[3], arn)
+	}
+
+	if repositoryArns, hasArns := event.ResourceProperties["RepositoryArns"]; hasArns {
+		if _, hasTargetReference := event.ResourceProperties["TargetReference"]; ok || hasTargetReference {
+			return nil, fmt.Errorf("RepositoryArns is mutually exclusive with RepositoryArn, RepositoryUri, RepositoryName and TargetReference")
+		}
+		arns, isList := getStringList(repositoryArns)
+		if !isList || len(arns) == 0 {
+			return nil, fmt.Errorf("RepositoryArns is not a list of strings")
+		}
+		for _, arn := range arns {
+			repository, err := getECRRepository(arn, result.UseFIPSEndpoint)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range result.Repositories {
+				if r.String() == repository.String() {
+					return nil, fmt.Errorf("RepositoryArns contains %s more than once", arn)
+				}
+			}
+			result.Repositories = append(result.Repositories, repository)
+		}
+		arn, ok = arns[0], true
+	}
+
+	var repository string
+	if targetReference, hasTargetReference := event.ResourceProperties["TargetReference"]; hasTargetReference {
+		if ok {
+			return nil, fmt.Errorf("TargetReference is mutually exclusive with RepositoryArn, RepositoryUri and RepositoryName")
+		}
+		if repository, err = parseTargetReference(targetReference, result); err != nil {
+			return nil, err
+		}
+	} else if ok {
+		registry, repositoryName, err := parseRepositoryArn(arn, result.UseFIPSEndpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Region = registry.region
+		result.AccountID = registry.accountID
+		result.RepositoryName = repositoryName
+		repository = fmt.Sprintf("%s/%s", registry, result.RepositoryName)
 	} else {
 		return nil, fmt.Errorf("RepositoryArn is missing or not a string")
 	}
 
-	if platform, ok := event.ResourceProperties["Platform"].(string); ok {
+	if result.UseFIPSEndpoint && result.Region == "" {
+		return nil, fmt.Errorf("UseFIPSEndpoint requires a target in an ECR registry")
+	}
+
+	targetTag := result.SourceTag
+	if result.TargetTag != "" && !isTagTemplate(result.TargetTag) {
+		targetTag = result.TargetTag
+	}
+
+	target := fmt.Sprintf("%s@%s", repository, result.SourceDigest)
+	if targetTag != "" {
+		target = fmt.Sprintf("%s:%s", repository, targetTag)
+	}
+	if result.Target, err = name.ParseReference(target); err != nil {
+		return nil, err
+	}
+
+	platformProperty, hasPlatform := event.ResourceProperties["Platform"]
+	if platform, ok := platformProperty.(string); ok && strings.Contains(platform, ",") {
+		platformProperty = strings.Split(platform, ",")
+	}
+
+	if platform, ok := platformProperty.(string); ok {
 		if strings.TrimSpace(strings.ToLower(platform)) == "all" {
 			result.Platform = nil
 		} else {
@@ -126,110 +248,507 @@ func validate(event cfn.Event) (*resourceProperties, error) {
 				return nil, fmt.Errorf("invalid Platform format, %s", err)
 			}
 		}
+	} else if platforms, ok := getStringList(platformProperty); ok {
+		for _, platform := range platforms {
+			var p *v1.Platform
+			if p, err = v1.ParsePlatform(strings.TrimSpace(platform)); err != nil {
+				return nil, fmt.Errorf("invalid Platform format, %s", err)
+			}
+			result.Platforms = append(result.Platforms, *p)
+		}
+		switch len(result.Platforms) {
+		case 0:
+			return nil, fmt.Errorf("Platform is an empty list")
+		case 1:
+			result.Platform, result.Platforms = &result.Platforms[0], nil
+		}
+	} else if hasPlatform {
+		return nil, fmt.Errorf("Platform is not a string or a list of strings")
 	} else {
 		// backwards compatible with first release
 		result.Platform = &v1.Platform{OS: "linux", Architecture: "amd64"}
 	}
+
+	if secretArn, ok := event.ResourceProperties["SourceCredentialsSecretArn"]; ok {
+		if result.SourceCredentialsSecretArn, ok = secretArn.(string); !ok || result.SourceCredentialsSecretArn == "" {
+			return nil, fmt.Errorf("SourceCredentialsSecretArn is not a string")
+		}
+	}
+
+	if registry, ok := parseECRRegistry(result.Source.Context().RegistryStr()); ok {
+		result.SourceAccountID = registry.accountID
+		result.SourceRegion = registry.region
+	}
+
+	if roleArn, ok := event.ResourceProperties["SourceRoleArn"]; ok {
+		if result.SourceRoleArn, ok = roleArn.(string); !ok || result.SourceRoleArn == "" {
+			return nil, fmt.Errorf("SourceRoleArn is not a string")
+		}
+		if result.SourceRegion == "" {
+			return nil, fmt.Errorf("SourceRoleArn requires an ImageReference in an ECR registry")
+		}
+		if result.SourceCredentialsSecretArn != "" {
+			return nil, fmt.Errorf("SourceRoleArn and SourceCredentialsSecretArn are mutually exclusive")
+		}
+	}
+
+	if result.CreateRepository, err = getRepositoryConfiguration(event.ResourceProperties); err != nil {
+		return nil, err
+	}
+
+	if signWith, ok := event.ResourceProperties["SignWith"]; ok {
+		if result.SignWith, ok = signWith.(string); !ok || !kmsKeyArnPattern.MatchString(result.SignWith) {
+			return nil, fmt.Errorf("SignWith is not a KMS key ARN")
+		}
+	}
+
+	if copyReferrers, ok := event.ResourceProperties["CopyReferrers"]; ok {
+		if result.CopyReferrers, ok = getBool(copyReferrers); !ok {
+			return nil, fmt.Errorf("CopyReferrers is not a boolean")
+		}
+	}
+
+	if verifySignature, ok := event.ResourceProperties["VerifySignature"]; ok {
+		if result.VerifySignature, err = getSignatureVerification(verifySignature); err != nil {
+			return nil, err
+		}
+	}
+
+	if retainOnDelete, ok := event.ResourceProperties["RetainOnDelete"]; ok {
+		if result.RetainOnDelete, err = parseRetainOnDelete(retainOnDelete); err != nil {
+			return nil, err
+		}
+	}
+
+	if roleArn, ok := event.ResourceProperties["TargetRoleArn"]; ok {
+		if result.TargetRoleArn, ok = roleArn.(string); !ok || result.TargetRoleArn == "" {
+			return nil, fmt.Errorf("TargetRoleArn is not a string")
+		}
+		if result.Region == "" {
+			return nil, fmt.Errorf("TargetRoleArn requires a target in an ECR registry")
+		}
+	}
+
+	if secretArn, ok := event.ResourceProperties["TargetCredentialsSecretArn"]; ok {
+		if result.TargetCredentialsSecretArn, ok = secretArn.(string); !ok || result.TargetCredentialsSecretArn == "" {
+			return nil, fmt.Errorf("TargetCredentialsSecretArn is not a string")
+		}
+		if result.Region != "" {
+			return nil, fmt.Errorf("TargetCredentialsSecretArn is not supported for a target in an ECR registry")
+		}
+	}
+
+	if result.CreateRepository != nil && result.Region == "" {
+		return nil, fmt.Errorf("CreateRepository requires a target in an ECR registry")
+	}
+
+	if err = providerPolicy.check(result); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
 
-func create(ctx context.Context, event cfn.Event, authenticator authn.Authenticator) (physicalResourceID string, data map[string]interface{}, err error) {
+// parseTargetReference sets the target repository of the properties to the reference, and returns the name
+// of the repository. A tag in the reference is the TargetTag.
+func parseTargetReference(value interface{}, result *resourceProperties) (string, error) {
+	targetReference, ok := value.(string)
+	if !ok || targetReference == "" {
+		return "", fmt.Errorf("TargetReference is not a string")
+	}
+
+	named, err := reference.ParseNormalizedNamed(targetReference)
+	if err != nil {
+		return "", fmt.Errorf("invalid TargetReference, %s", err)
+	}
+	if _, ok = named.(reference.Digested); ok {
+		return "", fmt.Errorf("TargetReference must not contain a digest")
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		if result.TargetTag != "" {
+			return "", fmt.Errorf("TargetReference and TargetTag are mutually exclusive")
+		}
+		result.TargetTag = tagged.Tag()
+	}
+
+	if registry, ok := parseECRRegistry(reference.Domain(named)); ok {
+		if result.UseFIPSEndpoint && !registry.fips {
+			return "", fmt.Errorf("UseFIPSEndpoint requires the FIPS registry %s in TargetReference", &ecrRegistry{accountID: registry.accountID, region: registry.region, partition: registry.partition, fips: true})
+		}
+		if err = validateRepositoryName(reference.Path(named)); err != nil {
+			return "", fmt.Errorf("invalid TargetReference, %s", err)
+		}
+		result.AccountID = registry.accountID
+		result.Region = registry.region
+		result.RepositoryName = reference.Path(named)
+		result.UseFIPSEndpoint = registry.fips
+	}
+	return named.Name(), nil
+}
+
+// parseRepositoryUri returns the ARN of the repository of an ECR repository URI, as returned by the
+// RepositoryUri attribute of an AWS::ECR::Repository. A FIPS registry enables UseFIPSEndpoint.
+func parseRepositoryUri(value interface{}, result *resourceProperties) (string, error) {
+	uri, ok := value.(string)
+	if !ok || uri == "" {
+		return "", fmt.Errorf("RepositoryUri is not a string")
+	}
+
+	named, err := reference.ParseNormalizedNamed(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid RepositoryUri %s, %s", uri, err)
+	}
+	if !reference.IsNameOnly(named) {
+		return "", fmt.Errorf("RepositoryUri %s must not contain a tag or digest", uri)
+	}
+
+	registry, ok := parseECRRegistry(reference.Domain(named))
+	if !ok {
+		return "", fmt.Errorf("RepositoryUri %s is not in an ECR registry", uri)
+	}
+	if result.UseFIPSEndpoint && !registry.fips {
+		return "", fmt.Errorf("UseFIPSEndpoint requires the FIPS registry in RepositoryUri %s", uri)
+	}
+	result.UseFIPSEndpoint = registry.fips
+	return fmt.Sprintf("arn:%s:ecr:%s:%s:repository/%s", registry.partition, registry.region, registry.accountID, reference.Path(named)), nil
+}
+
+// parseRepositoryArn returns the registry and the name of the repository of an ECR repository ARN.
+func parseRepositoryArn(arn string, fips bool) (*ecrRegistry, string, error) {
+	matches := ecrRepositoryArnPattern.FindStringSubmatch(arn)
+	if len(matches) != 5 {
+		return nil, "", fmt.Errorf("Invalid AWS ECR repository ARN: %s", arn)
+	}
+
+	registry, err := newECRRegistry(matches[1], matches[3], matches[2], fips)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid AWS ECR repository ARN: %s, %s", arn, err)
+	}
+	if err = validateRepositoryName(matches[4]); err != nil {
+		return nil, "", fmt.Errorf("Invalid AWS ECR repository ARN: %s, %s", arn, err)
+	}
+	return registry, matches[4], nil
+}
+
+// getECRRepository returns the repository of an ECR repository ARN.
+func getECRRepository(arn string, fips bool) (name.Repository, error) {
+	registry, repositoryName, err := parseRepositoryArn(arn, fips)
+	if err != nil {
+		return name.Repository{}, err
+	}
+	return name.NewRepository(fmt.Sprintf("%s/%s", registry, repositoryName))
+}
+
+func create(ctx context.Context, event cfn.Event, awsSession client.ConfigProvider, providerPolicy *policy, progress *continuation) (physicalResourceID string, data map[string]interface{}, err error) {
 	var properties *resourceProperties
-	if properties, err = validate(event); err != nil {
+	if properties, err = validate(event, providerPolicy); err != nil {
+		return "", nil, err
+	}
+	if err = providerPolicy.apply(properties); err != nil {
 		return "", nil, err
 	}
 
-	pullOptions := []remote.Option{
-		remote.WithContext(ctx),
+	if properties.CreateRepository != nil {
+		services := make([]ecriface.ECRAPI, 0, len(properties.Repositories)+1)
+		for _, target := range properties.getTargets() {
+			targetProperties := properties.withTarget(target)
+			services = append(services, newECRService(awsSession, targetProperties.Region, properties.TargetRoleArn, targetProperties.UseFIPSEndpoint))
+		}
+		defer func() {
+			if err != nil && !errors.Is(err, errContinued) && properties.RetainOnDelete != retainAlways {
+				deleteCreatedRepositories(services, properties, getCreatedBy(event))
+			}
+		}()
+		for i, target := range properties.getTargets() {
+			if err = ensureRepository(services[i], properties.withTarget(target), getCreatedBy(event)); err != nil {
+				return "", nil, err
+			}
+		}
 	}
-	if properties.Platform != nil {
-		pullOptions = append(pullOptions, remote.WithPlatform(*properties.Platform))
+
+	verifier, err := newSignatureVerifier(awsSession, properties.VerifySignature)
+	if err != nil {
+		return "", nil, err
 	}
 
-	puller, err := remote.NewPuller(pullOptions...)
+	registries := getTargetRegistries(awsSession, properties)
+	signer := newSigner(awsSession, properties.SignWith)
+	data, err = progress.run(ctx, event, lambda.New(awsSession), func(ctx context.Context) (map[string]interface{}, error) {
+		return copyImage(ctx, properties, awsSession, verifier, signer, registries, registryRetryPolicy)
+	})
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to create puller for repository: %w", err)
+		return "", nil, err
 	}
+	return getPhysicalResourceID(properties.Target, data["Digest"].(string)), data, nil
+}
 
-	pushOptions := []remote.Option{
-		remote.WithAuth(authenticator),
+// getSourceAuthenticator returns the authenticator for the source registry.
+func getSourceAuthenticator(awsSession client.ConfigProvider, properties *resourceProperties) (sourceAuthenticator authn.Authenticator, err error) {
+	sourceAuthenticator = authn.Anonymous
+	if properties.SourceCredentialsSecretArn != "" {
+		sourceAuthenticator, err = getSecretAuthentication(secretsmanager.New(awsSession), properties.SourceCredentialsSecretArn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get source credentials from %s: %w", properties.SourceCredentialsSecretArn, err)
+		}
+	} else if properties.SourceRegion != "" {
+		registry, _ := parseECRRegistry(properties.Source.Context().RegistryStr())
+		sourceAuthenticator, err = getAuthentication(newECRService(awsSession, properties.SourceRegion, properties.SourceRoleArn, registry.fips))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get authorization token for %s: %w", properties.Source.Context().RegistryStr(), err)
+		}
+	}
+	return sourceAuthenticator, nil
+}
+
+// sourceImage is the source image, as it is pushed to the target.
+type sourceImage struct {
+	source          name.Reference
+	descriptor      *remote.Descriptor
+	artifact        remote.Taggable
+	digest          v1.Hash
+	platforms       []string
+	platformDigests map[string]string
+	referrers       []referrer
+}
+
+// copyImage copies the source image to the targets, and returns the resource attributes. The Target of
+// the properties is updated to the reference of the pushed image. If the verifier is not nil, the image
+// is only copied if it has a valid signature. If the signer is not nil, the copied image is signed.
+func copyImage(ctx context.Context, properties *resourceProperties, awsSession client.ConfigProvider, verifier *signatureVerifier, signer signer, registries []targetRegistry, policy retryPolicy) (data map[string]interface{}, err error) {
+	image, sourceAuthenticator, err := resolveSource(ctx, awsSession, properties, policy)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySourceImage(ctx, image, sourceAuthenticator, verifier); err != nil {
+		return nil, err
+	}
+	return pushImageToTargets(ctx, properties, image, signer, registries, policy)
+}
+
+// verifySourceImage verifies the signature of the digest the source reference points to, unless the verifier is nil.
+func verifySourceImage(ctx context.Context, image *sourceImage, sourceAuthenticator authn.Authenticator, verifier *signatureVerifier) error {
+	if verifier == nil {
+		return nil
+	}
+	options := []remote.Option{
+		remote.WithAuth(sourceAuthenticator),
 		remote.WithContext(ctx),
 	}
+	if err := verifier.verify(image.source.Context(), image.descriptor.Digest, options); err != nil {
+		return fmt.Errorf("failed to verify the signature of %s: %w", image.source, err)
+	}
+	log.Printf("verified the signature of %s@%s", image.source.Context(), image.descriptor.Digest)
+	return nil
+}
 
-	pusher, err := remote.NewPusher(pushOptions...)
+// resolveImage gets the image from the source, the Source of the properties or its mirror, for the platforms
+// of the properties. Tag templates in the properties are expanded, and a digest Target is updated to the
+// digest of the image to push.
+func resolveImage(ctx context.Context, properties *resourceProperties, source name.Reference, sourceAuthenticator authn.Authenticator, policy retryPolicy) (*sourceImage, error) {
+	pullOptions := withRetries(ctx, policy,
+		remote.WithAuth(sourceAuthenticator),
+		remote.WithContext(ctx),
+	)
+	if properties.Platform != nil {
+		pullOptions = append(pullOptions, remote.WithPlatform(*properties.Platform))
+	}
+
+	puller, err := remote.NewPuller(pullOptions...)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to create pusher for repository: %w", err)
+		return nil, fmt.Errorf("failed to create puller for repository: %w", err)
 	}
 
-	descriptor, err := puller.Get(ctx, properties.Source)
+	var descriptor *remote.Descriptor
+	err = retry(ctx, policy, func() (err error) {
+		descriptor, err = puller.Get(ctx, source)
+		return err
+	})
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to get descriptor for repository: %w", err)
+		return nil, fmt.Errorf("failed to get descriptor for repository: %w", err)
 	}
 
-	if properties.Platform == nil {
-		err = pusher.Push(ctx, properties.Target, descriptor)
-		if err != nil {
-			return "", nil, fmt.Errorf("failed to push descriptor: %w", err)
-		}
-	} else {
+	result := &sourceImage{
+		source:          source,
+		descriptor:      descriptor,
+		artifact:        descriptor,
+		digest:          descriptor.Digest,
+		platformDigests: make(map[string]string),
+	}
+	if properties.Platform != nil {
 		image, err := descriptor.Image()
 		if err != nil {
-			return "", nil, fmt.Errorf("failed to get the platform specific image from descriptor: %w", err)
+			return nil, fmt.Errorf("failed to get the platform specific image from descriptor: %w", err)
 		}
-		err = pusher.Push(ctx, properties.Target, image)
+		if result.digest, err = image.Digest(); err != nil {
+			return nil, fmt.Errorf("failed to get the digest of the platform specific image: %w", err)
+		}
+		result.artifact = image
+		result.platforms = []string{properties.Platform.String()}
+		result.platformDigests[properties.Platform.String()] = result.digest.String()
+	} else if len(properties.Platforms) > 0 {
+		index, err := descriptor.ImageIndex()
 		if err != nil {
-			return "", nil, fmt.Errorf("failed to push image: %w", err)
+			return nil, fmt.Errorf("failed to get the image index from descriptor: %w", err)
+		}
+		if index, err = filterIndex(index, properties.Platforms); err != nil {
+			return nil, err
+		}
+		if result.digest, err = index.Digest(); err != nil {
+			return nil, fmt.Errorf("failed to get the digest of the image index: %w", err)
+		}
+		result.artifact = index
+		result.platforms = getIndexPlatforms(index)
+		result.platformDigests = getIndexPlatformDigests(index)
+	} else {
+		result.platforms = getPlatforms(descriptor)
+		if index, err := descriptor.ImageIndex(); err == nil {
+			result.platformDigests = getIndexPlatformDigests(index)
 		}
 	}
 
-	var platforms []string
-	if properties.Platform != nil {
-		platforms = []string{properties.Platform.String()}
-	} else {
-		platforms = getPlatforms(descriptor)
+	if properties.CopyReferrers {
+		// the referrers of the artifact that is pushed, as a filtered image index has none
+		if result.referrers, err = getReferrers(source.Context(), result.digest, pullOptions); err != nil {
+			return nil, err
+		}
+	}
+
+	if properties.hasTagTemplates() {
+		templateData, err := getTagTemplateData(properties, descriptor, result.artifact)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the tag template data: %w", err)
+		}
+		if err = properties.expandTags(templateData); err != nil {
+			return nil, err
+		}
 	}
 
-	data = map[string]interface{}{
-		"Digest":         descriptor.Digest.String(),
-		"ImageReference": properties.Target.String(),
-		"Platforms":      platforms,
+	if _, ok := properties.Target.(name.Digest); ok {
+		// a digest reference must match the digest of the pushed artifact
+		properties.Target = properties.Target.Context().Digest(result.digest.String())
 	}
+	return result, nil
+}
 
-	return properties.Target.String(), data, nil
+// getTags returns the tags of the target image, without duplicates.
+func (p *resourceProperties) getTags() []string {
+	tags := make([]string, 0, len(p.AdditionalTags)+1)
+	if tag, ok := p.Target.(name.Tag); ok {
+		tags = append(tags, tag.TagStr())
+	}
+	for _, tag := range p.AdditionalTags {
+		if !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
 }
 
-func getPlatforms(descriptor *remote.Descriptor) (platforms []string) {
-	platforms = make([]string, 0)
+// pushImage pushes the image to the Target and the additional tags, except for the existing references
+// which already point to the image, and returns the resource attributes.
+func pushImage(ctx context.Context, properties *resourceProperties, image *sourceImage, authenticator authn.Authenticator, existing map[string]bool, policy retryPolicy) (data map[string]interface{}, err error) {
+	pushOptions := withRetries(ctx, policy,
+		remote.WithAuth(authenticator),
+		remote.WithContext(ctx),
+	)
 
-	if index, err := descriptor.ImageIndex(); err == nil {
-		if indexManifest, err := index.IndexManifest(); err == nil {
-			for _, manifest := range indexManifest.Manifests {
-				if manifest.Platform != nil {
-					platforms = append(platforms, manifest.Platform.String())
-				}
+	pusher, err := remote.NewPusher(pushOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pusher for repository: %w", err)
+	}
+
+	if existing[properties.Target.String()] {
+		log.Printf("image %s already contains %s, skipping push", properties.Target, image.digest)
+	} else if err = retry(ctx, policy, func() error { return pusher.Push(ctx, properties.Target, image.artifact) }); err != nil {
+		return nil, fmt.Errorf("failed to push image: %w", err)
+	}
+
+	tags := properties.getTags()
+	for _, tag := range tags {
+		if tagReference := properties.Target.Context().Tag(tag); tagReference.String() != properties.Target.String() && !existing[tagReference.String()] {
+			if err = retry(ctx, policy, func() error { return pusher.Push(ctx, tagReference, image.artifact) }); err != nil {
+				return nil, fmt.Errorf("failed to tag image with %s: %w", tag, err)
 			}
 		}
 	}
-	return
+
+	for _, referrer := range image.referrers {
+		if err = retry(ctx, policy, func() error {
+			return pusher.Push(ctx, referrer.getReferrerReference(properties.Target.Context()), referrer.artifact)
+		}); err != nil {
+			return nil, fmt.Errorf("failed to copy the referrer %s: %w", referrer.artifact.Digest, err)
+		}
+	}
+
+	return image.attributes(properties, tags), nil
 }
 
-func delete(ctx context.Context, event cfn.Event, authenticator authn.Authenticator) (physicalResourceID string, data map[string]interface{}, err error) {
-	var imageReference name.Reference
-	if imageReference, err = name.ParseReference(event.PhysicalResourceID); err == nil {
-		deleteOptions := []remote.Option{
-			remote.WithAuth(authenticator),
-			remote.WithContext(ctx),
+// attributes returns the resource attributes of the image pushed to the Target with the tags.
+func (image *sourceImage) attributes(properties *resourceProperties, tags []string) map[string]interface{} {
+	data := map[string]interface{}{
+		"Digest":          image.digest.String(),
+		"SourceDigest":    image.descriptor.Digest.String(),
+		"ResolvedSource":  image.source.String(),
+		"ImageReference":  properties.Target.String(),
+		"ImageReferences": properties.getTargetStrings(),
+		"Platforms":       image.platforms,
+		"Tags":            tags,
+		"PlatformDigests": image.platformDigests,
+		"Referrers":       image.getReferrerDigests(),
+	}
+	for platform, platformDigest := range image.platformDigests {
+		data["Digest."+platform] = platformDigest
+	}
+	return data
+}
+
+func getStringList(value interface{}) ([]string, bool) {
+	switch values := value.(type) {
+	case []string:
+		return values, true
+	case []interface{}:
+		result := make([]string, 0, len(values))
+		for _, v := range values {
+			s, ok := v.(string)
+			if !ok {
+				return nil, false
+			}
+			result = append(result, s)
 		}
-		if err = remote.Delete(imageReference, deleteOptions...); err != nil {
-			log.Printf("ignoring failed delete of image %s, %s", event.PhysicalResourceID, err)
+		return result, true
+	default:
+		return nil, false
+	}
+}
+
+func contains(s []string, str string) bool {
+	for _, v := range s {
+		if v == str {
+			return true
 		}
-	} else {
-		log.Printf("ignoring invalid physical resource id %s", event.PhysicalResourceID)
 	}
-	return physicalResourceID, nil, nil
+	return false
+}
+
+func getPlatforms(descriptor *remote.Descriptor) (platforms []string) {
+	if index, err := descriptor.ImageIndex(); err == nil {
+		return getIndexPlatforms(index)
+	}
+	return make([]string, 0)
+}
+
+// newECRService returns an ECR client for the region, using the credentials of the role if specified.
+func newECRService(awsSession client.ConfigProvider, region string, roleArn string, fips bool) *ecr.ECR {
+	config := aws.NewConfig().WithRegion(region)
+	if fips {
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if roleArn != "" {
+		config = config.WithCredentials(stscreds.NewCredentials(awsSession, roleArn))
+	}
+	return ecr.New(awsSession, config)
 }
 
-func getAuthentication(svc *ecr.ECR) (*authn.Basic, error) {
+func getAuthentication(svc ecriface.ECRAPI) (*authn.Basic, error) {
 	var err error
 	var response *ecr.GetAuthorizationTokenOutput
 	response, err = svc.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
@@ -254,10 +773,49 @@ func getAuthentication(svc *ecr.ECR) (*authn.Basic, error) {
 	return &authn.Basic{Username: parts[0], Password: parts[1]}, nil
 }
 
+// registryCredentials is the JSON format of the secret referenced by SourceCredentialsSecretArn
+type registryCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+func getSecretAuthentication(svc secretsmanageriface.SecretsManagerAPI, secretArn string) (authn.Authenticator, error) {
+	response, err := svc.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(secretArn)})
+	if err != nil {
+		return nil, err
+	}
+	if response.SecretString == nil {
+		return nil, fmt.Errorf("secret has no string value")
+	}
+
+	var credentials registryCredentials
+	if err = json.Unmarshal([]byte(*response.SecretString), &credentials); err != nil {
+		return nil, fmt.Errorf("secret is not a valid JSON object, %s", err)
+	}
+
+	if credentials.Username != "" && credentials.Password != "" {
+		return &authn.Basic{Username: credentials.Username, Password: credentials.Password}, nil
+	}
+	if credentials.Token != "" {
+		// the token is the password with which the registry issues its bearer token, like a personal access token
+		username := credentials.Username
+		if username == "" {
+			username = "token"
+		}
+		return &authn.Basic{Username: username, Password: credentials.Token}, nil
+	}
+	return nil, fmt.Errorf("secret must contain either a username and password, or a token")
+}
+
 func Handler(ctx context.Context, event cfn.Event) (physicalResourceID string, data map[string]interface{}, err error) {
+	return handle(ctx, event, nil)
+}
+
+// handle handles the request. A copy with a continuation which runs out of time continues in a new
+// invocation of the provider.
+func handle(ctx context.Context, event cfn.Event, progress *continuation) (physicalResourceID string, data map[string]interface{}, err error) {
 	var awsSession *session.Session
-	var ecrService *ecr.ECR
-	var basicAuthentication *authn.Basic
 
 	logs.Warn.SetOutput(os.Stderr)
 	logs.Progress.SetOutput(os.Stderr)
@@ -265,26 +823,29 @@ func Handler(ctx context.Context, event cfn.Event) (physicalResourceID string, d
 	if awsSession, err = session.NewSessionWithOptions(
 		session.Options{SharedConfigState: session.SharedConfigEnable}); err != nil {
 		return "", nil, err
-	} else {
-		ecrService = ecr.New(awsSession)
-	}
-
-	if basicAuthentication, err = getAuthentication(ecrService); err != nil {
-		return "", nil, err
 	}
 
 	if strings.Compare(event.ResourceType, "Custom::ContainerImage") == 0 {
+		var providerPolicy *policy
+		if event.RequestType == cfn.RequestCreate || event.RequestType == cfn.RequestUpdate {
+			if providerPolicy, err = getProviderPolicy(awsSession); err != nil {
+				return "", nil, err
+			}
+		}
+
 		switch event.RequestType {
 		case cfn.RequestCreate:
-			physicalResourceID, data, err = create(ctx, event, basicAuthentication)
+			physicalResourceID, data, err = create(ctx, event, awsSession, providerPolicy, progress)
 			if physicalResourceID == "" {
 				physicalResourceID = "create-failed"
 			}
 			return physicalResourceID, data, err
 		case cfn.RequestUpdate:
-			return create(ctx, event, basicAuthentication)
+			// an update copies the image as on create. Only the references which do not point to the
+			// resolved source image yet are pushed, so an update which does not change the image pushes nothing.
+			return create(ctx, event, awsSession, providerPolicy, progress)
 		case cfn.RequestDelete:
-			return delete(ctx, event, basicAuthentication)
+			return delete(ctx, event, awsSession)
 		default:
 			return "", nil, fmt.Errorf("unsupported request type: %s", event.RequestType)
 		}
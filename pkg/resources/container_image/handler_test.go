@@ -2,17 +2,27 @@ package container_image
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
 	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/registry"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 
 	"github.com/google/go-containerregistry/pkg/name"
@@ -36,13 +46,16 @@ func mustParsePlatform(s string) *v1.Platform {
 	return result
 }
 
-func contains(s []string, str string) bool {
-	for _, v := range s {
-		if v == str {
-			return true
-		}
-	}
-	return false
+// newTestRegistry starts a local registry, which is closed at the end of the test, and returns its host.
+func newTestRegistry(t *testing.T) string {
+	return newTestServer(t, registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+}
+
+// newTestServer starts a server with the handler, which is closed at the end of the test, and returns its host.
+func newTestServer(t *testing.T, handler http.Handler) string {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
 }
 
 func Test_validate(t *testing.T) {
@@ -105,83 +118,1159 @@ func Test_validate(t *testing.T) {
 			wantErr:        false,
 			wantErrMessage: "",
 		},
-
+
+		{
+			name: "DigestWithTag",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceDigest:   "sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "TagOnly",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "SpecificPlatform",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"Platform":       "linux/arm64",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/arm64"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "MultiArchitecture",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"Platform":       "all",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       nil,
+			},
+			wantErr: false,
+		},
+		{
+			name: "PlatformList",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"Platform":       []interface{}{"linux/amd64", "linux/arm64"},
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platforms:      []v1.Platform{*mustParsePlatform("linux/amd64"), *mustParsePlatform("linux/arm64")},
+			},
+			wantErr: false,
+		},
+		{
+			name: "CommaSeparatedPlatforms",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"Platform":       "linux/amd64, linux/arm64/v8",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platforms:      []v1.Platform{*mustParsePlatform("linux/amd64"), *mustParsePlatform("linux/arm64/v8")},
+			},
+			wantErr: false,
+		},
+		{
+			name: "SinglePlatformList",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"Platform":       []interface{}{"linux/arm64"},
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/arm64"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "InvalidPlatformList",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"Platform":       map[string]interface{}{"os": "linux"},
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "Platform is not a string or a list of strings",
+		},
+		{
+			name: "RetainOnDelete",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"RetainOnDelete": true,
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+				RetainOnDelete: "true",
+			},
+			wantErr: false,
+		},
+		{
+			name: "RetainOnDeleteIfReferenced",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"RetainOnDelete": "ifreferenced",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+				RetainOnDelete: "IfReferenced",
+			},
+			wantErr: false,
+		},
+		{
+			name: "InvalidRetainOnDelete",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"RetainOnDelete": "sometimes",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "RetainOnDelete must be true, false or IfReferenced",
+		},
+		{
+			name: "RepositoryName",
+			args: args{
+				event: cfn.Event{
+					StackID: "arn:aws:cloudformation:eu-central-1:444093529715:stack/demo/a2b2f800-0000-11ee-0000-000000000000",
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":   "docker.io/library/python:3.9",
+						"RepositoryName":   "mirror/python",
+						"CreateRepository": "true",
+						"ScanOnPush":       "true",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:           mustParse("python:3.9"),
+				Target:           mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/mirror/python:3.9"),
+				Region:           "eu-central-1",
+				AccountID:        "444093529715",
+				RepositoryName:   "mirror/python",
+				SourceTag:        "3.9",
+				SourceName:       "docker.io/library/python",
+				Platform:         mustParsePlatform("linux/amd64"),
+				CreateRepository: &repositoryConfiguration{ScanOnPush: true},
+			},
+			wantErr: false,
+		},
+		{
+			name: "RepositoryNameAndArn",
+			args: args{
+				event: cfn.Event{
+					StackID: "arn:aws:cloudformation:eu-central-1:444093529715:stack/demo/a2b2f800-0000-11ee-0000-000000000000",
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryName": "python",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "RepositoryName is mutually exclusive with RepositoryArn and RepositoryUri",
+		},
+		{
+			name: "RepositoryNameWithoutStack",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryName": "python",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: `RepositoryName requires the account and region of the stack, ""`,
+		},
+		{
+			name: "RepositoryUri",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryUri":  "444093529715.dkr.ecr.eu-central-1.amazonaws.com/mirror/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/mirror/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "mirror/python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "RepositoryUriFIPS",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryUri":  "444093529715.dkr.ecr-fips.us-gov-west-1.amazonaws.com/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:          mustParse("python:3.9"),
+				Target:          mustParse("444093529715.dkr.ecr-fips.us-gov-west-1.amazonaws.com/python:3.9"),
+				Region:          "us-gov-west-1",
+				AccountID:       "444093529715",
+				RepositoryName:  "python",
+				SourceTag:       "3.9",
+				SourceName:      "docker.io/library/python",
+				Platform:        mustParsePlatform("linux/amd64"),
+				UseFIPSEndpoint: true,
+			},
+			wantErr: false,
+		},
+		{
+			name: "RepositoryUriDoesNotMatchArn",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryUri":  "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python",
+						"RepositoryArn":  "arn:aws:ecr:eu-west-1:444093529715:repository/python",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "RepositoryUri is mutually exclusive with RepositoryArn",
+		},
+		{
+			name: "RepositoryUriAndMatchingArn",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryUri":  "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "RepositoryUri is mutually exclusive with RepositoryArn",
+		},
+		{
+			name: "RepositoryUriNotECR",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryUri":  "ghcr.io/binxio/python",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "RepositoryUri ghcr.io/binxio/python is not in an ECR registry",
+		},
+		{
+			name: "RepositoryUriWithTag",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryUri":  "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "RepositoryUri 444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9 must not contain a tag or digest",
+		},
+		{
+			name: "TargetReference",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":             "docker.io/library/python:3.9",
+						"TargetReference":            "ghcr.io/binxio/python",
+						"TargetCredentialsSecretArn": "arn:aws:secretsmanager:eu-central-1:444093529715:secret:ghcr",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:                     mustParse("python:3.9"),
+				Target:                     mustParse("ghcr.io/binxio/python:3.9"),
+				SourceTag:                  "3.9",
+				SourceName:                 "docker.io/library/python",
+				Platform:                   mustParsePlatform("linux/amd64"),
+				TargetCredentialsSecretArn: "arn:aws:secretsmanager:eu-central-1:444093529715:secret:ghcr",
+			},
+			wantErr: false,
+		},
+		{
+			name: "TargetReferenceWithTag",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  "docker.io/library/python:3.9",
+						"TargetReference": "harbor.example.com/mirror/python:stable",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:     mustParse("python:3.9"),
+				Target:     mustParse("harbor.example.com/mirror/python:stable"),
+				SourceTag:  "3.9",
+				SourceName: "docker.io/library/python",
+				Platform:   mustParsePlatform("linux/amd64"),
+				TargetTag:  "stable",
+			},
+			wantErr: false,
+		},
+		{
+			name: "TargetReferenceInECR",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  "docker.io/library/python:3.9",
+						"TargetReference": "444093529715.dkr.ecr.eu-central-1.amazonaws.com/mirror/python",
+						"TargetRoleArn":   "arn:aws:iam::444093529715:role/ecr-push",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/mirror/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "mirror/python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+				TargetRoleArn:  "arn:aws:iam::444093529715:role/ecr-push",
+			},
+			wantErr: false,
+		},
+		{
+			name: "TargetReferenceAndRepositoryArn",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  "docker.io/library/python:3.9",
+						"TargetReference": "ghcr.io/binxio/python",
+						"RepositoryArn":   "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "TargetReference is mutually exclusive with RepositoryArn, RepositoryUri and RepositoryName",
+		},
+		{
+			name: "TargetReferenceWithDigest",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  "docker.io/library/python:3.9",
+						"TargetReference": "ghcr.io/binxio/python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "TargetReference must not contain a digest",
+		},
+		{
+			name: "TargetRoleArnWithoutECR",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  "docker.io/library/python:3.9",
+						"TargetReference": "ghcr.io/binxio/python",
+						"TargetRoleArn":   "arn:aws:iam::444093529715:role/ecr-push",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "TargetRoleArn requires a target in an ECR registry",
+		},
+		{
+			name: "TargetCredentialsInECR",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":             "docker.io/library/python:3.9",
+						"RepositoryArn":              "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"TargetCredentialsSecretArn": "arn:aws:secretsmanager:eu-central-1:444093529715:secret:ghcr",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "TargetCredentialsSecretArn is not supported for a target in an ECR registry",
+		},
+		{
+			name: "CreateRepositoryWithoutECR",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":   "docker.io/library/python:3.9",
+						"TargetReference":  "ghcr.io/binxio/python",
+						"CreateRepository": "true",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "CreateRepository requires a target in an ECR registry",
+		},
+		{
+			name: "RepositoryArns",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArns": []interface{}{
+							"arn:aws:ecr:eu-central-1:444093529715:repository/python",
+							"arn:aws:ecr:eu-west-1:444093529715:repository/python",
+						},
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+				Region:         "eu-central-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+				Repositories: []name.Repository{
+					mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python").Context(),
+					mustParse("444093529715.dkr.ecr.eu-west-1.amazonaws.com/python").Context(),
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "RepositoryArnsAndRepositoryArn",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"RepositoryArns": []interface{}{"arn:aws:ecr:eu-west-1:444093529715:repository/python"},
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "RepositoryArns is mutually exclusive with RepositoryArn, RepositoryUri, RepositoryName and TargetReference",
+		},
+		{
+			name: "DuplicateRepositoryArns",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArns": []interface{}{
+							"arn:aws:ecr:eu-west-1:444093529715:repository/python",
+							"arn:aws:ecr:eu-west-1:444093529715:repository/python",
+						},
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "RepositoryArns contains arn:aws:ecr:eu-west-1:444093529715:repository/python more than once",
+		},
+		{
+			name: "EmptyRepositoryArns",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArns": []interface{}{},
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "RepositoryArns is not a list of strings",
+		},
+		{
+			name: "PartitionChina",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws-cn:ecr:cn-north-1:444093529715:repository/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.cn-north-1.amazonaws.com.cn/python:3.9"),
+				Region:         "cn-north-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "PartitionGovCloud",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws-us-gov:ecr:us-gov-west-1:444093529715:repository/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.us-gov-west-1.amazonaws.com/python:3.9"),
+				Region:         "us-gov-west-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "PartitionISO",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws-iso:ecr:us-iso-east-1:444093529715:repository/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.us-iso-east-1.c2s.ic.gov/python:3.9"),
+				Region:         "us-iso-east-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "PartitionISOB",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws-iso-b:ecr:us-isob-east-1:444093529715:repository/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.us-isob-east-1.sc2s.sgov.gov/python:3.9"),
+				Region:         "us-isob-east-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "FIPS",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  "docker.io/library/python:3.9",
+						"RepositoryArn":   "arn:aws:ecr:us-east-1:444093529715:repository/python",
+						"UseFIPSEndpoint": "true",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:          mustParse("python:3.9"),
+				Target:          mustParse("444093529715.dkr.ecr-fips.us-east-1.amazonaws.com/python:3.9"),
+				Region:          "us-east-1",
+				AccountID:       "444093529715",
+				RepositoryName:  "python",
+				SourceTag:       "3.9",
+				SourceName:      "docker.io/library/python",
+				Platform:        mustParsePlatform("linux/amd64"),
+				UseFIPSEndpoint: true,
+			},
+			wantErr: false,
+		},
+		{
+			name: "FIPSGovCloud",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  "docker.io/library/python:3.9",
+						"RepositoryArn":   "arn:aws-us-gov:ecr:us-gov-east-1:444093529715:repository/python",
+						"UseFIPSEndpoint": true,
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:          mustParse("python:3.9"),
+				Target:          mustParse("444093529715.dkr.ecr-fips.us-gov-east-1.amazonaws.com/python:3.9"),
+				Region:          "us-gov-east-1",
+				AccountID:       "444093529715",
+				RepositoryName:  "python",
+				SourceTag:       "3.9",
+				SourceName:      "docker.io/library/python",
+				Platform:        mustParsePlatform("linux/amd64"),
+				UseFIPSEndpoint: true,
+			},
+			wantErr: false,
+		},
+		{
+			name: "RepositoryNameInChina",
+			args: args{
+				event: cfn.Event{
+					StackID: "arn:aws-cn:cloudformation:cn-northwest-1:444093529715:stack/demo/a2b2f800-0000-11ee-0000-000000000000",
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryName": "python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.cn-northwest-1.amazonaws.com.cn/python:3.9"),
+				Region:         "cn-northwest-1",
+				AccountID:      "444093529715",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "FIPSTargetReference",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  "docker.io/library/python:3.9",
+						"TargetReference": "444093529715.dkr.ecr-fips.us-west-2.amazonaws.com/python",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:          mustParse("python:3.9"),
+				Target:          mustParse("444093529715.dkr.ecr-fips.us-west-2.amazonaws.com/python:3.9"),
+				Region:          "us-west-2",
+				AccountID:       "444093529715",
+				RepositoryName:  "python",
+				SourceTag:       "3.9",
+				SourceName:      "docker.io/library/python",
+				Platform:        mustParsePlatform("linux/amd64"),
+				UseFIPSEndpoint: true,
+			},
+			wantErr: false,
+		},
+		{
+			name: "FIPSChina",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  "docker.io/library/python:3.9",
+						"RepositoryArn":   "arn:aws-cn:ecr:cn-north-1:444093529715:repository/python",
+						"UseFIPSEndpoint": "true",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "Invalid AWS ECR repository ARN: arn:aws-cn:ecr:cn-north-1:444093529715:repository/python, AWS partition aws-cn has no FIPS endpoints",
+		},
+		{
+			name: "UnknownPartition",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws-mars:ecr:mars-east-1:444093529715:repository/python",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "Invalid AWS ECR repository ARN: arn:aws-mars:ecr:mars-east-1:444093529715:repository/python, unsupported AWS partition aws-mars",
+		},
+		{
+			name: "RegionNotInPartition",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:cn-north-1:444093529715:repository/python",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "Invalid AWS ECR repository ARN: arn:aws:ecr:cn-north-1:444093529715:repository/python, region cn-north-1 is not in AWS partition aws",
+		},
+		{
+			name: "InvalidUseFIPSEndpoint",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  "docker.io/library/python:3.9",
+						"RepositoryArn":   "arn:aws:ecr:us-east-1:444093529715:repository/python",
+						"UseFIPSEndpoint": "maybe",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "UseFIPSEndpoint is not a boolean",
+		},
+		{
+			name: "IncorrectName",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "https://docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "https://docker.io/library/python:3.9: invalid reference format",
+		},
+		{
+			name: "IncorrectARN",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:a:ws:ecr:eu-ce:ntral-1:444093529715:repository/python",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "Invalid AWS ECR repository ARN: arn:a:ws:ecr:eu-ce:ntral-1:444093529715:repository/python",
+		},
+		{
+			name: "ConsecutiveSeparatorsInARN",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/mirror/py--thon",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: `Invalid AWS ECR repository ARN: arn:aws:ecr:eu-central-1:444093529715:repository/mirror/py--thon, repository name "mirror/py--thon" has an invalid segment "py--thon", it must consist of lowercase letters and digits separated by a single period, underscore or hyphen`,
+		},
+		{
+			name: "TrailingSlashInARN",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/mirror/",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: `Invalid AWS ECR repository ARN: arn:aws:ecr:eu-central-1:444093529715:repository/mirror/, repository name "mirror/" has an empty segment at position 2`,
+		},
+		{
+			name: "InvalidRepositoryName",
+			args: args{
+				event: cfn.Event{
+					StackID: "arn:aws:cloudformation:eu-central-1:444093529715:stack/demo/a2b2f800-0000-11ee-0000-000000000000",
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryName": "mirror/Python",
+					},
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "CopyReferrersNotBoolean",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"CopyReferrers":  "yes",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "CopyReferrers is not a boolean",
+		},
+		{
+			name: "SignWithNotKMSKey",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"SignWith":       "alias/cosign",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "SignWith is not a KMS key ARN",
+		},
+		{
+			name: "MissingReference",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "ImageReference is missing or not a string",
+		},
+		{
+			name: "MissingARN",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "RepositoryArn is missing or not a string",
+		},
+		{
+			name: "InvalidPlatform",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"Platform":       "linux/sdfasdf/more/sdfsdfd/dsdfsfd",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+					},
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "SourceCredentials",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":             "ghcr.io/binxio/private:1.0.0",
+						"RepositoryArn":              "arn:aws:ecr:eu-central-1:444093529715:repository/private",
+						"SourceCredentialsSecretArn": "arn:aws:secretsmanager:eu-central-1:444093529715:secret:ghcr-AbCdEf",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:                     mustParse("ghcr.io/binxio/private:1.0.0"),
+				Target:                     mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/private:1.0.0"),
+				Region:                     "eu-central-1",
+				AccountID:                  "444093529715",
+				RepositoryName:             "private",
+				SourceTag:                  "1.0.0",
+				SourceName:                 "ghcr.io/binxio/private",
+				Platform:                   mustParsePlatform("linux/amd64"),
+				SourceCredentialsSecretArn: "arn:aws:secretsmanager:eu-central-1:444093529715:secret:ghcr-AbCdEf",
+			},
+			wantErr: false,
+		},
+		{
+			name: "InvalidSourceCredentials",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":             "ghcr.io/binxio/private:1.0.0",
+						"RepositoryArn":              "arn:aws:ecr:eu-central-1:444093529715:repository/private",
+						"SourceCredentialsSecretArn": 42,
+					},
+				},
+			},
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "SourceCredentialsSecretArn is not a string",
+		},
+		{
+			name: "CrossAccountSource",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "123456789012.dkr.ecr.eu-west-1.amazonaws.com/build/app:1.2.3",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/app",
+						"SourceRoleArn":  "arn:aws:iam::123456789012:role/ecr-pull",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:          mustParse("123456789012.dkr.ecr.eu-west-1.amazonaws.com/build/app:1.2.3"),
+				Target:          mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/app:1.2.3"),
+				Region:          "eu-central-1",
+				AccountID:       "444093529715",
+				RepositoryName:  "app",
+				SourceTag:       "1.2.3",
+				SourceName:      "123456789012.dkr.ecr.eu-west-1.amazonaws.com/build/app",
+				Platform:        mustParsePlatform("linux/amd64"),
+				SourceRoleArn:   "arn:aws:iam::123456789012:role/ecr-pull",
+				SourceRegion:    "eu-west-1",
+				SourceAccountID: "123456789012",
+			},
+			wantErr: false,
+		},
+		{
+			name: "CrossAccountTarget",
+			args: args{
+				event: cfn.Event{
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:us-east-1:123456789012:repository/python",
+						"TargetRoleArn":  "arn:aws:iam::123456789012:role/ecr-push",
+					},
+				},
+			},
+			want: &resourceProperties{
+				Source:         mustParse("python:3.9"),
+				Target:         mustParse("123456789012.dkr.ecr.us-east-1.amazonaws.com/python:3.9"),
+				Region:         "us-east-1",
+				AccountID:      "123456789012",
+				RepositoryName: "python",
+				SourceTag:      "3.9",
+				SourceName:     "docker.io/library/python",
+				Platform:       mustParsePlatform("linux/amd64"),
+				TargetRoleArn:  "arn:aws:iam::123456789012:role/ecr-push",
+			},
+			wantErr: false,
+		},
 		{
-			name: "DigestWithTag",
+			name: "TargetTag",
 			args: args{
 				event: cfn.Event{
 					ResourceProperties: map[string]interface{}{
 						"ImageReference": "docker.io/library/python:3.9@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659",
-						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python-base",
+						"TargetTag":      "2024-q3",
+						"AdditionalTags": []interface{}{"stable", "3d35a404"},
 					},
 				},
 			},
 			want: &resourceProperties{
 				Source:         mustParse("python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659"),
-				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python-base:2024-q3"),
 				Region:         "eu-central-1",
 				AccountID:      "444093529715",
-				RepositoryName: "python",
+				RepositoryName: "python-base",
 				SourceTag:      "3.9",
 				SourceDigest:   "sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659",
 				SourceName:     "docker.io/library/python",
 				Platform:       mustParsePlatform("linux/amd64"),
+				TargetTag:      "2024-q3",
+				AdditionalTags: []string{"stable", "3d35a404"},
 			},
 			wantErr: false,
 		},
 		{
-			name: "TagOnly",
+			name: "DigestWithTargetTag",
 			args: args{
 				event: cfn.Event{
 					ResourceProperties: map[string]interface{}{
-						"ImageReference": "docker.io/library/python:3.9",
+						"ImageReference": "docker.io/library/python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659",
 						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"TargetTag":      "3.9",
 					},
 				},
 			},
 			want: &resourceProperties{
-				Source:         mustParse("python:3.9"),
+				Source:         mustParse("python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659"),
 				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
 				Region:         "eu-central-1",
 				AccountID:      "444093529715",
 				RepositoryName: "python",
-				SourceTag:      "3.9",
+				SourceDigest:   "sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659",
 				SourceName:     "docker.io/library/python",
 				Platform:       mustParsePlatform("linux/amd64"),
+				TargetTag:      "3.9",
 			},
 			wantErr: false,
 		},
 		{
-			name: "SpecificPlatform",
+			name: "InvalidTargetTag",
 			args: args{
 				event: cfn.Event{
 					ResourceProperties: map[string]interface{}{
 						"ImageReference": "docker.io/library/python:3.9",
-						"Platform":       "linux/arm64",
 						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"TargetTag":      "-invalid",
 					},
 				},
 			},
-			want: &resourceProperties{
-				Source:         mustParse("python:3.9"),
-				Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
-				Region:         "eu-central-1",
-				AccountID:      "444093529715",
-				RepositoryName: "python",
-				SourceTag:      "3.9",
-				SourceName:     "docker.io/library/python",
-				Platform:       mustParsePlatform("linux/arm64"),
-			},
-			wantErr: false,
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "invalid TargetTag, -invalid is not a valid tag",
 		},
 		{
-			name: "MultiArchitecture",
+			name: "TargetTagTemplate",
 			args: args{
 				event: cfn.Event{
 					ResourceProperties: map[string]interface{}{
 						"ImageReference": "docker.io/library/python:3.9",
-						"Platform":       "all",
 						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"TargetTag":      "{{.SourceTag}}-{{.ShortDigest}}",
 					},
 				},
 			},
@@ -193,75 +1282,71 @@ func Test_validate(t *testing.T) {
 				RepositoryName: "python",
 				SourceTag:      "3.9",
 				SourceName:     "docker.io/library/python",
-				Platform:       nil,
+				Platform:       mustParsePlatform("linux/amd64"),
+				TargetTag:      "{{.SourceTag}}-{{.ShortDigest}}",
 			},
 			wantErr: false,
 		},
 		{
-			name: "IncorrectName",
+			name: "InvalidTargetTagTemplate",
 			args: args{
 				event: cfn.Event{
 					ResourceProperties: map[string]interface{}{
-						"ImageReference": "https://docker.io/library/python:3.9",
+						"ImageReference": "docker.io/library/python:3.9",
 						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"TargetTag":      "{{.Tag}}",
 					},
 				},
 			},
 			want:           nil,
 			wantErr:        true,
-			wantErrMessage: "https://docker.io/library/python:3.9: invalid reference format",
+			wantErrMessage: `invalid TargetTag, template: tag:1:2: executing "tag" at <.Tag>: can't evaluate field Tag in type container_image.tagTemplateData`,
 		},
 		{
-			name: "IncorrectARN",
+			name: "InvalidAdditionalTags",
 			args: args{
 				event: cfn.Event{
 					ResourceProperties: map[string]interface{}{
 						"ImageReference": "docker.io/library/python:3.9",
-						"RepositoryArn":  "arn:a:ws:ecr:eu-ce:ntral-1:444093529715:repository/python",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"AdditionalTags": []interface{}{"stable", 1},
 					},
 				},
 			},
 			want:           nil,
 			wantErr:        true,
-			wantErrMessage: "Invalid AWS ECR repository ARN: arn:a:ws:ecr:eu-ce:ntral-1:444093529715:repository/python",
-		},
-		{
-			name: "MissingReference",
-			args: args{
-				event: cfn.Event{
-					ResourceProperties: map[string]interface{}{},
-				},
-			},
-			want:           nil,
-			wantErr:        true,
-			wantErrMessage: "ImageReference is missing or not a string",
+			wantErrMessage: "AdditionalTags is not a list of strings",
 		},
 		{
-			name: "MissingARN",
+			name: "SourceRoleWithoutECR",
 			args: args{
 				event: cfn.Event{
 					ResourceProperties: map[string]interface{}{
 						"ImageReference": "docker.io/library/python:3.9",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"SourceRoleArn":  "arn:aws:iam::123456789012:role/ecr-pull",
 					},
 				},
 			},
 			want:           nil,
 			wantErr:        true,
-			wantErrMessage: "RepositoryArn is missing or not a string",
+			wantErrMessage: "SourceRoleArn requires an ImageReference in an ECR registry",
 		},
 		{
-			name: "InvalidPlatform",
+			name: "SourceRoleAndCredentials",
 			args: args{
 				event: cfn.Event{
 					ResourceProperties: map[string]interface{}{
-						"ImageReference": "docker.io/library/python:3.9",
-						"Platform":       "linux/sdfasdf/more/sdfsdfd/dsdfsfd",
-						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+						"ImageReference":             "123456789012.dkr.ecr.eu-west-1.amazonaws.com/build/app:1.2.3",
+						"RepositoryArn":              "arn:aws:ecr:eu-central-1:444093529715:repository/app",
+						"SourceRoleArn":              "arn:aws:iam::123456789012:role/ecr-pull",
+						"SourceCredentialsSecretArn": "arn:aws:secretsmanager:eu-central-1:444093529715:secret:ghcr-AbCdEf",
 					},
 				},
 			},
-			want:    nil,
-			wantErr: true,
+			want:           nil,
+			wantErr:        true,
+			wantErrMessage: "SourceRoleArn and SourceCredentialsSecretArn are mutually exclusive",
 		},
 		{
 			name: "LatestAndDigest",
@@ -289,7 +1374,7 @@ func Test_validate(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := validate(tt.args.event)
+			got, err := validate(tt.args.event, nil)
 			if err != nil && tt.wantErrMessage != "" && tt.wantErrMessage != err.Error() {
 				t.Errorf("validate() error = %v, wantErrMessage %v", err, tt.wantErrMessage)
 				return
@@ -306,7 +1391,136 @@ func Test_validate(t *testing.T) {
 	}
 }
 
+// repositoryNameGrammar is the ECR repository name grammar of the ECR API reference.
+var repositoryNameGrammar = regexp.MustCompile(`^(?:[a-z0-9]+(?:[._-][a-z0-9]+)*/)*[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+
+func Fuzz_validate(f *testing.F) {
+	for _, seed := range []string{"python", "mirror/python", "mirror/py--thon", "mirror/", "/python", "mirror//python", "a-_b", "p", "1python", "Python", "py.thon_3-9/x"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, repositoryName string) {
+		for _, properties := range []map[string]interface{}{
+			{"RepositoryName": repositoryName},
+			{"RepositoryArn": "arn:aws:ecr:eu-central-1:444093529715:repository/" + repositoryName},
+			{"TargetReference": "444093529715.dkr.ecr.eu-central-1.amazonaws.com/" + repositoryName},
+		} {
+			properties["ImageReference"] = "docker.io/library/python:3.9"
+			got, err := validate(cfn.Event{
+				StackID:            "arn:aws:cloudformation:eu-central-1:444093529715:stack/demo/a2b2f800-0000-11ee-0000-000000000000",
+				ResourceProperties: properties,
+			}, nil)
+			valid := len(repositoryName) >= 2 && len(repositoryName) <= 256 && repositoryNameGrammar.MatchString(repositoryName)
+			if _, isTargetReference := properties["TargetReference"]; isTargetReference && err != nil {
+				// the reference grammar may reject names that are valid in ECR, but never accepts an invalid one
+				continue
+			}
+			if (err == nil) != valid {
+				t.Fatalf("validate(%v) error = %v, valid %v", properties, err, valid)
+			}
+			if err == nil && (got.RepositoryName != repositoryName || got.Target.Context().RepositoryStr() != repositoryName) {
+				t.Fatalf("validate(%v) repository = %s, %s, want %s", properties, got.RepositoryName, got.Target.Context().RepositoryStr(), repositoryName)
+			}
+		}
+	})
+}
+
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets map[string]string
+}
+
+func (f *fakeSecretsManager) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	if secret, ok := f.secrets[aws.StringValue(input.SecretId)]; ok {
+		return &secretsmanager.GetSecretValueOutput{ARN: input.SecretId, SecretString: aws.String(secret)}, nil
+	}
+	return nil, fmt.Errorf("ResourceNotFoundException: Secrets Manager can't find the specified secret")
+}
+
+func Test_getSecretAuthentication(t *testing.T) {
+	svc := &fakeSecretsManager{secrets: map[string]string{
+		"basic":    `{"username": "binxio", "password": "s3cr3t"}`,
+		"token":    `{"token": "ghp_0123456789"}`,
+		"robot":    `{"username": "binxio+robot", "token": "0123456789"}`,
+		"empty":    `{}`,
+		"notjson":  `binxio:s3cr3t`,
+		"password": `{"password": "s3cr3t"}`,
+	}}
+	tests := []struct {
+		name           string
+		secretArn      string
+		want           authn.AuthConfig
+		wantErrMessage string
+	}{
+		{name: "basic", secretArn: "basic", want: authn.AuthConfig{Username: "binxio", Password: "s3cr3t"}},
+		{name: "token", secretArn: "token", want: authn.AuthConfig{Username: "token", Password: "ghp_0123456789"}},
+		{name: "username and token", secretArn: "robot", want: authn.AuthConfig{Username: "binxio+robot", Password: "0123456789"}},
+		{name: "empty", secretArn: "empty", wantErrMessage: "secret must contain either a username and password, or a token"},
+		{name: "password only", secretArn: "password", wantErrMessage: "secret must contain either a username and password, or a token"},
+		{name: "not json", secretArn: "notjson", wantErrMessage: "secret is not a valid JSON object, invalid character 'b' looking for beginning of value"},
+		{name: "missing", secretArn: "missing", wantErrMessage: "ResourceNotFoundException: Secrets Manager can't find the specified secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getSecretAuthentication(svc, tt.secretArn)
+			if tt.wantErrMessage != "" {
+				if err == nil || err.Error() != tt.wantErrMessage {
+					t.Errorf("getSecretAuthentication() error = %v, wantErrMessage %v", err, tt.wantErrMessage)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getSecretAuthentication() error = %v", err)
+			}
+			config, err := got.Authorization()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*config, tt.want) {
+				t.Errorf("getSecretAuthentication() got = %v, want %v", *config, tt.want)
+			}
+		})
+	}
+}
+
+type fakeECR struct {
+	ecriface.ECRAPI
+	token string
+}
+
+func (f *fakeECR) GetAuthorizationToken(*ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	return &ecr.GetAuthorizationTokenOutput{
+		AuthorizationData: []*ecr.AuthorizationData{{AuthorizationToken: aws.String(f.token)}},
+	}, nil
+}
+
+func Test_getAuthentication(t *testing.T) {
+	got, err := getAuthentication(&fakeECR{token: base64.StdEncoding.EncodeToString([]byte("AWS:s3cr3t"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&authn.Basic{Username: "AWS", Password: "s3cr3t"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("getAuthentication() got = %v, want %v", got, want)
+	}
+
+	_, err = getAuthentication(&fakeECR{token: base64.StdEncoding.EncodeToString([]byte("AWS"))})
+	if err == nil || err.Error() != "token seperated by : contains 1 elements, not 2" {
+		t.Errorf("getAuthentication() error = %v", err)
+	}
+}
+
 func Test_handler(t *testing.T) {
+	// the Local cases copy an image between repositories of a local registry
+	host := newTestRegistry(t)
+	index := mustMultiPlatformIndex(t, "linux/amd64", "linux/arm64", "linux/s390x")
+	indexDigest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	platformDigests := getIndexPlatformDigests(index)
+	if err = remote.WriteIndex(mustParse(host+"/library/python:3.9"), index); err != nil {
+		t.Fatal(err)
+	}
+
 	type args struct {
 		ctx   context.Context
 		event cfn.Event
@@ -316,9 +1530,81 @@ func Test_handler(t *testing.T) {
 		args                   args
 		wantPhysicalResourceID string
 		wantData               map[string]interface{}
+		wantDigest             string
+		wantSourceDigest       string
 		wantErr                bool
 		wantErrMessage         string
 	}{
+		{
+			name: "LocalTag",
+			args: args{
+				ctx: context.Background(),
+				event: cfn.Event{
+					ResourceType: "Custom::ContainerImage",
+					RequestType:  "Create",
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  host + "/library/python:3.9",
+						"TargetReference": host + "/mirror/python:3.9",
+					},
+				},
+			},
+			wantPhysicalResourceID: host + "/mirror/python:3.9",
+			wantDigest:             platformDigests["linux/amd64"],
+			wantSourceDigest:       indexDigest.String(),
+		},
+		{
+			name: "LocalPlatform",
+			args: args{
+				ctx: context.Background(),
+				event: cfn.Event{
+					ResourceType: "Custom::ContainerImage",
+					RequestType:  "Create",
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  host + "/library/python:3.9",
+						"Platform":        "linux/arm64",
+						"TargetReference": host + "/mirror/python:arm64",
+					},
+				},
+			},
+			wantPhysicalResourceID: host + "/mirror/python:arm64",
+			wantDigest:             platformDigests["linux/arm64"],
+			wantSourceDigest:       indexDigest.String(),
+		},
+		{
+			name: "LocalDigestOnlyAllPlatforms",
+			args: args{
+				ctx: context.Background(),
+				event: cfn.Event{
+					ResourceType: "Custom::ContainerImage",
+					RequestType:  "Create",
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  host + "/library/python@" + indexDigest.String(),
+						"Platform":        "all",
+						"TargetReference": host + "/mirror/python:all",
+					},
+				},
+			},
+			wantPhysicalResourceID: host + "/mirror/python:all",
+			wantDigest:             indexDigest.String(),
+			wantSourceDigest:       indexDigest.String(),
+		},
+		{
+			name: "LocalPlatformSubset",
+			args: args{
+				ctx: context.Background(),
+				event: cfn.Event{
+					ResourceType: "Custom::ContainerImage",
+					RequestType:  "Create",
+					ResourceProperties: map[string]interface{}{
+						"ImageReference":  host + "/library/python:3.9",
+						"Platform":        []interface{}{"linux/amd64", "linux/arm64"},
+						"TargetReference": host + "/mirror/python:subset",
+					},
+				},
+			},
+			wantPhysicalResourceID: host + "/mirror/python:subset",
+			wantSourceDigest:       indexDigest.String(),
+		},
 		{
 			name: "withTagAndDigest",
 			args: args{
@@ -365,6 +1651,26 @@ func Test_handler(t *testing.T) {
 					},
 				},
 			},
+			// the linux/amd64 image of the index is pushed, so the physical resource id refers to the Digest of
+			// the platform manifest, rather than to the digest of the ImageReference
+			wantPhysicalResourceID: "444093529715.dkr.ecr.eu-central-1.amazonaws.com/cfn-container-image-provider-demo",
+			wantErr:                false,
+			wantErrMessage:         "",
+		},
+		{
+			name: "DigestOnlyAllPlatforms",
+			args: args{
+				ctx: context.Background(),
+				event: cfn.Event{
+					ResourceType: "Custom::ContainerImage",
+					RequestType:  "Create",
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659",
+						"Platform":       "all",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/cfn-container-image-provider-demo",
+					},
+				},
+			},
 			wantPhysicalResourceID: "444093529715.dkr.ecr.eu-central-1.amazonaws.com/cfn-container-image-provider-demo@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659",
 			wantErr:                false,
 			wantErrMessage:         "",
@@ -386,6 +1692,46 @@ func Test_handler(t *testing.T) {
 			wantErr:                false,
 			wantErrMessage:         "",
 		},
+		{
+			name: "TargetAndAdditionalTags",
+			args: args{
+				ctx: context.Background(),
+				event: cfn.Event{
+					ResourceType: "Custom::ContainerImage",
+					RequestType:  "Create",
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "docker.io/library/python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659",
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/cfn-container-image-provider-demo",
+						"TargetTag":      "python-3.9",
+						"AdditionalTags": []interface{}{"stable", "python-3.9"},
+					},
+				},
+			},
+			wantPhysicalResourceID: "444093529715.dkr.ecr.eu-central-1.amazonaws.com/cfn-container-image-provider-demo:python-3.9",
+			wantData: map[string]interface{}{
+				"Tags": []string{"python-3.9", "stable"},
+			},
+			wantErr:        false,
+			wantErrMessage: "",
+		},
+		{
+			name: "PlatformSubset",
+			args: args{
+				ctx: context.Background(),
+				event: cfn.Event{
+					ResourceType: "Custom::ContainerImage",
+					RequestType:  "Create",
+					ResourceProperties: map[string]interface{}{
+						"ImageReference": "python:3.9.18",
+						"Platform":       []interface{}{"linux/amd64", "linux/arm64"},
+						"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/cfn-container-image-provider-demo",
+					},
+				},
+			},
+			wantPhysicalResourceID: "444093529715.dkr.ecr.eu-central-1.amazonaws.com/cfn-container-image-provider-demo:3.9.18",
+			wantErr:                false,
+			wantErrMessage:         "",
+		},
 		{
 			name: "MultiArchitecture",
 			args: args{
@@ -433,13 +1779,42 @@ func Test_handler(t *testing.T) {
 					t.Errorf("handler() error, no Digest in wantData")
 					return
 				}
+				if tt.wantDigest != "" && gotData["Digest"] != tt.wantDigest {
+					t.Errorf("handler() Digest = %s, want %s", gotData["Digest"], tt.wantDigest)
+				}
+				if tt.wantSourceDigest != "" && gotData["SourceDigest"] != tt.wantSourceDigest {
+					t.Errorf("handler() SourceDigest = %s, want %s", gotData["SourceDigest"], tt.wantSourceDigest)
+				}
+
+				if sourceDigest, ok := gotData["SourceDigest"].(string); ok {
+					if ref, ok := mustParse(tt.args.event.ResourceProperties["ImageReference"].(string)).(name.Digest); ok && ref.DigestStr() != sourceDigest {
+						t.Errorf("handler() SourceDigest = %s, want %s", sourceDigest, ref.DigestStr())
+					}
+				} else {
+					t.Errorf("handler() error, no SourceDigest in wantData")
+					return
+				}
+
+				if platform, ok := tt.args.event.ResourceProperties["Platform"].(string); !ok || platform != "all" {
+					if platformDigests, ok := gotData["PlatformDigests"].(map[string]string); ok && len(platformDigests) == 1 {
+						for _, digest := range platformDigests {
+							if gotData["Digest"] != digest {
+								t.Errorf("handler() Digest = %s, want the pushed image digest %s", gotData["Digest"], digest)
+							}
+						}
+					}
+				}
 
 				if platforms, ok := gotData["Platforms"].([]string); ok {
 					platform, ok := tt.args.event.ResourceProperties["Platform"].(string)
 					if !ok {
 						platform = "linux/amd64"
 					}
-					if platform == "all" {
+					if subset, ok := getStringList(tt.args.event.ResourceProperties["Platform"]); ok {
+						if !reflect.DeepEqual(platforms, subset) {
+							t.Errorf("expected platforms %s, got %s", subset, platforms)
+						}
+					} else if platform == "all" {
 						if len(platforms) <= 1 {
 							t.Errorf("expected multiple platform images, got %d", len(platforms))
 						}
@@ -454,10 +1829,36 @@ func Test_handler(t *testing.T) {
 
 				}
 
+				if platformDigests, ok := gotData["PlatformDigests"].(map[string]string); ok {
+					for platform, digest := range platformDigests {
+						if gotData["Digest."+platform] != digest {
+							t.Errorf("handler() Digest.%s = %v, want %s", platform, gotData["Digest."+platform], digest)
+						}
+					}
+					platforms, _ := gotData["Platforms"].([]string)
+					for _, platform := range platforms {
+						if _, ok := platformDigests[platform]; !ok {
+							t.Errorf("handler() no digest for platform %s in PlatformDigests %v", platform, platformDigests)
+						}
+					}
+				} else {
+					t.Errorf("handler() error, no PlatformDigests in wantData")
+					return
+				}
+
+				if tags, ok := tt.wantData["Tags"]; ok && !reflect.DeepEqual(gotData["Tags"], tags) {
+					t.Errorf("handler() got Tags = %v, want %v", gotData["Tags"], tags)
+				}
+
 			}
 
-			if gotPhysicalResourceID != tt.wantPhysicalResourceID {
-				t.Errorf("handler() gotPhysicalResourceID = %v, want %v", gotPhysicalResourceID, tt.wantPhysicalResourceID)
+			wantPhysicalResourceID := tt.wantPhysicalResourceID
+			if digest, ok := gotData["Digest"].(string); ok && !strings.Contains(wantPhysicalResourceID, "@") {
+				// the physical resource id pins the tag to the pushed digest
+				wantPhysicalResourceID = wantPhysicalResourceID + "@" + digest
+			}
+			if gotPhysicalResourceID != wantPhysicalResourceID {
+				t.Errorf("handler() gotPhysicalResourceID = %v, want %v", gotPhysicalResourceID, wantPhysicalResourceID)
 			}
 
 			tt.args.event.RequestType = "Delete"
@@ -471,6 +1872,64 @@ func Test_handler(t *testing.T) {
 	}
 }
 
+func Test_getExistingReferences(t *testing.T) {
+	host := newTestRegistry(t)
+
+	source := mustParse(host + "/library/python:3.9")
+	if err := remote.WriteIndex(source, mustMultiPlatformIndex(t, "linux/amd64", "linux/arm64")); err != nil {
+		t.Fatal(err)
+	}
+
+	properties := resourceProperties{
+		Source:         source,
+		Target:         mustParse(host + "/mirror/python:3.9"),
+		Platform:       mustParsePlatform("linux/arm64"),
+		AdditionalTags: []string{"stable"},
+	}
+
+	image, err := resolveImage(context.Background(), &properties, properties.Source, authn.Anonymous, registryRetryPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getExistingReferences(context.Background(), &properties, image, authn.Anonymous); len(got) != 0 {
+		t.Errorf("getExistingReferences() = %v before the image was pushed", got)
+	}
+
+	if _, err = pushImage(context.Background(), &properties, image, authn.Anonymous, nil, registryRetryPolicy); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{host + "/mirror/python:3.9": true, host + "/mirror/python:stable": true}
+	if got := getExistingReferences(context.Background(), &properties, image, authn.Anonymous); !reflect.DeepEqual(got, want) {
+		t.Errorf("getExistingReferences() = %v after the image was pushed, want %v", got, want)
+	}
+
+	// only the missing tag is pushed
+	properties.AdditionalTags = []string{"stable", "latest"}
+	existing := getExistingReferences(context.Background(), &properties, image, authn.Anonymous)
+	if !reflect.DeepEqual(existing, want) {
+		t.Errorf("getExistingReferences() = %v with a tag which was not pushed, want %v", existing, want)
+	}
+	data, err := pushImage(context.Background(), &properties, image, authn.Anonymous, existing, registryRetryPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data["Tags"], []string{"3.9", "stable", "latest"}) {
+		t.Errorf("pushImage() Tags = %v, want all tags", data["Tags"])
+	}
+	if got := getExistingReferences(context.Background(), &properties, image, authn.Anonymous); len(got) != 3 {
+		t.Errorf("getExistingReferences() = %v after the missing tag was pushed", got)
+	}
+
+	properties.AdditionalTags = []string{"stable"}
+	properties.Platform = mustParsePlatform("linux/amd64")
+	if image, err = resolveImage(context.Background(), &properties, properties.Source, authn.Anonymous, registryRetryPolicy); err != nil {
+		t.Fatal(err)
+	}
+	if got := getExistingReferences(context.Background(), &properties, image, authn.Anonymous); len(got) != 0 {
+		t.Errorf("getExistingReferences() = %v for another platform", got)
+	}
+}
+
 func Test_tagging_image(t *testing.T) {
 	var err error
 	var awsSession *session.Session
@@ -513,15 +1972,15 @@ func Test_tagging_image(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			if d, ok := digestResult["Digest"].(string); !ok || d != digest {
+			if d, ok := digestResult["SourceDigest"].(string); !ok || d != digest {
 				t.Logf("incorrect digest returned:\ngot: %s\nexp: %s\n", d, digest)
 			}
 			descriptor, err := remote.Get(mustParse(physicalResourceId), pullOptions...)
 			if err != nil {
 				t.Fatal(err)
 			}
-			if descriptor.Digest.String() != digest {
-				t.Logf("got: %s\nexp: %s\n", descriptor.Digest, digest)
+			if descriptor.Digest.String() != digestResult["Digest"] {
+				t.Logf("got: %s\nexp: %s\n", descriptor.Digest, digestResult["Digest"])
 			}
 		}
 	}
@@ -0,0 +1,72 @@
+package container_image
+
+import (
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// filterIndex returns a new image index with only the manifests of the index which satisfy one of
+// the platforms. It is an error if a platform is not available in the index.
+func filterIndex(index v1.ImageIndex, platforms []v1.Platform) (v1.ImageIndex, error) {
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	addenda := make([]mutate.IndexAddendum, 0, len(platforms))
+	for _, platform := range platforms {
+		found := false
+		for _, manifest := range indexManifest.Manifests {
+			if manifest.Platform == nil || !manifest.Platform.Satisfies(platform) {
+				continue
+			}
+
+			image, err := index.Image(manifest.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the image for platform %s: %w", manifest.Platform, err)
+			}
+			addenda = append(addenda, mutate.IndexAddendum{
+				Add: image,
+				Descriptor: v1.Descriptor{
+					MediaType:   manifest.MediaType,
+					Platform:    manifest.Platform,
+					Annotations: manifest.Annotations,
+				},
+			})
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("platform %s is not available in the image index", platform.String())
+		}
+	}
+
+	return mutate.AppendManifests(mutate.IndexMediaType(empty.Index, indexManifest.MediaType), addenda...), nil
+}
+
+func getIndexPlatforms(index v1.ImageIndex) (platforms []string) {
+	platforms = make([]string, 0)
+	if indexManifest, err := index.IndexManifest(); err == nil {
+		for _, manifest := range indexManifest.Manifests {
+			if manifest.Platform != nil {
+				platforms = append(platforms, manifest.Platform.String())
+			}
+		}
+	}
+	return
+}
+
+// getIndexPlatformDigests returns the digest of the manifest of each platform in the index.
+func getIndexPlatformDigests(index v1.ImageIndex) map[string]string {
+	digests := make(map[string]string)
+	if indexManifest, err := index.IndexManifest(); err == nil {
+		for _, manifest := range indexManifest.Manifests {
+			if manifest.Platform != nil {
+				digests[manifest.Platform.String()] = manifest.Digest.String()
+			}
+		}
+	}
+	return digests
+}
@@ -0,0 +1,82 @@
+package container_image
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func mustMultiPlatformIndex(t *testing.T, platforms ...string) v1.ImageIndex {
+	addenda := make([]mutate.IndexAddendum, 0, len(platforms))
+	for _, platform := range platforms {
+		image, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addenda = append(addenda, mutate.IndexAddendum{
+			Add: image,
+			Descriptor: v1.Descriptor{
+				MediaType: types.DockerManifestSchema2,
+				Platform:  mustParsePlatform(platform),
+			},
+		})
+	}
+	return mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.DockerManifestList), addenda...)
+}
+
+func Test_filterIndex(t *testing.T) {
+	index := mustMultiPlatformIndex(t, "linux/amd64", "linux/arm64/v8", "linux/s390x", "linux/ppc64le")
+	sourceDigests := getIndexPlatformDigests(index)
+	if len(sourceDigests) != 4 {
+		t.Fatalf("getIndexPlatformDigests() = %v, want 4 platforms", sourceDigests)
+	}
+
+	tests := []struct {
+		name           string
+		platforms      []string
+		want           []string
+		wantErrMessage string
+	}{
+		{name: "subset", platforms: []string{"linux/amd64", "linux/arm64"}, want: []string{"linux/amd64", "linux/arm64/v8"}},
+		{name: "order of platforms", platforms: []string{"linux/s390x", "linux/amd64"}, want: []string{"linux/s390x", "linux/amd64"}},
+		{name: "missing platform", platforms: []string{"linux/amd64", "windows/amd64"}, wantErrMessage: "platform windows/amd64 is not available in the image index"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			platforms := make([]v1.Platform, 0, len(tt.platforms))
+			for _, platform := range tt.platforms {
+				platforms = append(platforms, *mustParsePlatform(platform))
+			}
+
+			got, err := filterIndex(index, platforms)
+			if tt.wantErrMessage != "" {
+				if err == nil || err.Error() != tt.wantErrMessage {
+					t.Errorf("filterIndex() error = %v, wantErrMessage %v", err, tt.wantErrMessage)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("filterIndex() error = %v", err)
+			}
+
+			if platforms := getIndexPlatforms(got); !reflect.DeepEqual(platforms, tt.want) {
+				t.Errorf("filterIndex() platforms = %v, want %v", platforms, tt.want)
+			}
+			if mediaType, err := got.MediaType(); err != nil || mediaType != types.DockerManifestList {
+				t.Errorf("filterIndex() media type = %s, want %s", mediaType, types.DockerManifestList)
+			}
+
+			digests := getIndexPlatformDigests(got)
+			for _, platform := range tt.want {
+				if digests[platform] != sourceDigests[platform] {
+					t.Errorf("filterIndex() digest of %s = %s, want %s", platform, digests[platform], sourceDigests[platform])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package container_image
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// resolveSource gets the source image from the mirror of the source, and returns it with the
+// authenticator of the registry it was pulled from. Without a mirror, or if the pull from the mirror
+// fails and MirrorFallback is set, the image is pulled from the source registry.
+func resolveSource(ctx context.Context, awsSession client.ConfigProvider, properties *resourceProperties, policy retryPolicy) (*sourceImage, authn.Authenticator, error) {
+	if properties.Mirror != nil {
+		mirrorAuthenticator, err := getMirrorAuthenticator(awsSession, properties.Mirror)
+		if err == nil {
+			var image *sourceImage
+			if image, err = resolveImage(ctx, properties, properties.Mirror, mirrorAuthenticator, policy); err == nil {
+				log.Printf("pulled %s from the mirror %s", properties.Source, properties.Mirror)
+				return image, mirrorAuthenticator, nil
+			}
+		}
+		if !properties.MirrorFallback {
+			return nil, nil, fmt.Errorf("failed to pull %s from the mirror %s: %w", properties.Source, properties.Mirror, err)
+		}
+		log.Printf("failed to pull %s from the mirror %s, falling back to the source, %s", properties.Source, properties.Mirror, err)
+	}
+
+	sourceAuthenticator, err := getSourceAuthenticator(awsSession, properties)
+	if err != nil {
+		return nil, nil, err
+	}
+	image, err := resolveImage(ctx, properties, properties.Source, sourceAuthenticator, policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	return image, sourceAuthenticator, nil
+}
+
+// getMirrorAuthenticator returns the authenticator of the mirror: an ECR authorization token for a mirror
+// in ECR, like a pull-through cache, or anonymous.
+func getMirrorAuthenticator(awsSession client.ConfigProvider, mirror name.Reference) (authn.Authenticator, error) {
+	registry, ok := parseECRRegistry(mirror.Context().RegistryStr())
+	if !ok {
+		return authn.Anonymous, nil
+	}
+	authenticator, err := getAuthentication(newECRService(awsSession, registry.region, "", registry.fips))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get authorization token for %s: %w", registry, err)
+	}
+	return authenticator, nil
+}
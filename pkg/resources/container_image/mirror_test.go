@@ -0,0 +1,58 @@
+package container_image
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func Test_copyImage_mirror(t *testing.T) {
+	host := newTestRegistry(t)
+
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repository := range []string{"/upstream/python:3.9", "/mirror/python:3.9", "/upstream/golang:1.20"} {
+		if err = remote.Write(mustParse(host+repository), image); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		source         string
+		mirrorFallback bool
+		want           string
+		wantErr        bool
+	}{
+		{name: "mirrored", source: host + "/upstream/python:3.9", want: host + "/mirror/python:3.9"},
+		{name: "not in mirror", source: host + "/upstream/golang:1.20", wantErr: true},
+		{name: "fallback", source: host + "/upstream/golang:1.20", mirrorFallback: true, want: host + "/upstream/golang:1.20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &policy{Mirrors: map[string]string{host + "/upstream": host + "/mirror"}, MirrorFallback: tt.mirrorFallback}
+			properties := &resourceProperties{
+				SourceName:     tt.source,
+				Source:         mustParse(tt.source),
+				Target:         mustParse(host + "/" + strings.ReplaceAll(tt.name, " ", "-") + "/image:latest"),
+				MirrorFallback: p.MirrorFallback,
+			}
+			if properties.Mirror, err = p.getMirror(properties); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := copyImage(context.Background(), properties, nil, nil, nil, []targetRegistry{&genericTargetRegistry{}}, registryRetryPolicy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("copyImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && data["ResolvedSource"] != tt.want {
+				t.Errorf("copyImage() ResolvedSource = %v, want %s", data["ResolvedSource"], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package container_image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ecrPartition is the DNS suffix of the ECR registries in an AWS partition, the prefix of its regions
+// and whether it has FIPS endpoints.
+type ecrPartition struct {
+	dnsSuffix    string
+	regionPrefix string
+	fips         bool
+}
+
+// ecrPartitions are the AWS partitions with ECR.
+var ecrPartitions = map[string]ecrPartition{
+	"aws":        {dnsSuffix: "amazonaws.com", fips: true},
+	"aws-cn":     {dnsSuffix: "amazonaws.com.cn", regionPrefix: "cn-"},
+	"aws-us-gov": {dnsSuffix: "amazonaws.com", regionPrefix: "us-gov-", fips: true},
+	"aws-iso":    {dnsSuffix: "c2s.ic.gov", regionPrefix: "us-iso-"},
+	"aws-iso-b":  {dnsSuffix: "sc2s.sgov.gov", regionPrefix: "us-isob-"},
+}
+
+// getPartition returns the partition of the region.
+func getPartition(region string) string {
+	for name, partition := range ecrPartitions {
+		if partition.regionPrefix != "" && strings.HasPrefix(region, partition.regionPrefix) {
+			return name
+		}
+	}
+	return "aws"
+}
+
+var ecrRegistryPattern = regexp.MustCompile(`^(\d{12})\.dkr\.(ecr|ecr-fips)\.([a-z\d-]+)\.([a-z\d.]+)$`)
+
+// ecrRegistry is the ECR registry of an account in a region.
+type ecrRegistry struct {
+	accountID string
+	region    string
+	partition string
+	fips      bool
+}
+
+// newECRRegistry returns the ECR registry of the account in the region of the partition.
+func newECRRegistry(partition string, accountID string, region string, fips bool) (*ecrRegistry, error) {
+	if _, ok := ecrPartitions[partition]; !ok {
+		return nil, fmt.Errorf("unsupported AWS partition %s", partition)
+	}
+	if getPartition(region) != partition {
+		return nil, fmt.Errorf("region %s is not in AWS partition %s", region, partition)
+	}
+	if fips && !ecrPartitions[partition].fips {
+		return nil, fmt.Errorf("AWS partition %s has no FIPS endpoints", partition)
+	}
+	return &ecrRegistry{accountID: accountID, region: region, partition: partition, fips: fips}, nil
+}
+
+// parseECRRegistry returns the ECR registry of the registry host name, or false if it is not an ECR registry.
+func parseECRRegistry(host string) (*ecrRegistry, bool) {
+	matches := ecrRegistryPattern.FindStringSubmatch(host)
+	if len(matches) != 5 {
+		return nil, false
+	}
+
+	partition := getPartition(matches[3])
+	if ecrPartitions[partition].dnsSuffix != matches[4] {
+		return nil, false
+	}
+	registry, err := newECRRegistry(partition, matches[1], matches[3], matches[2] == "ecr-fips")
+	if err != nil {
+		return nil, false
+	}
+	return registry, true
+}
+
+// String returns the host name of the registry.
+func (r *ecrRegistry) String() string {
+	service := "ecr"
+	if r.fips {
+		service = "ecr-fips"
+	}
+	return fmt.Sprintf("%s.dkr.%s.%s.%s", r.accountID, service, r.region, ecrPartitions[r.partition].dnsSuffix)
+}
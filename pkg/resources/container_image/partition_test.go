@@ -0,0 +1,35 @@
+package container_image
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseECRRegistry(t *testing.T) {
+	tests := []struct {
+		host string
+		want *ecrRegistry
+	}{
+		{host: "444093529715.dkr.ecr.eu-central-1.amazonaws.com", want: &ecrRegistry{accountID: "444093529715", region: "eu-central-1", partition: "aws"}},
+		{host: "444093529715.dkr.ecr-fips.us-east-1.amazonaws.com", want: &ecrRegistry{accountID: "444093529715", region: "us-east-1", partition: "aws", fips: true}},
+		{host: "444093529715.dkr.ecr.cn-north-1.amazonaws.com.cn", want: &ecrRegistry{accountID: "444093529715", region: "cn-north-1", partition: "aws-cn"}},
+		{host: "444093529715.dkr.ecr-fips.us-gov-west-1.amazonaws.com", want: &ecrRegistry{accountID: "444093529715", region: "us-gov-west-1", partition: "aws-us-gov", fips: true}},
+		{host: "444093529715.dkr.ecr.us-iso-east-1.c2s.ic.gov", want: &ecrRegistry{accountID: "444093529715", region: "us-iso-east-1", partition: "aws-iso"}},
+		{host: "444093529715.dkr.ecr.us-isob-east-1.sc2s.sgov.gov", want: &ecrRegistry{accountID: "444093529715", region: "us-isob-east-1", partition: "aws-iso-b"}},
+		{host: "444093529715.dkr.ecr.cn-north-1.amazonaws.com"},
+		{host: "444093529715.dkr.ecr-fips.cn-north-1.amazonaws.com.cn"},
+		{host: "public.ecr.aws"},
+		{host: "ghcr.io"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, ok := parseECRRegistry(tt.host)
+			if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseECRRegistry() = %v, %v, want %v", got, ok, tt.want)
+			}
+			if ok && got.String() != tt.host {
+				t.Errorf("String() = %s, want %s", got, tt.host)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package container_image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	reference "github.com/docker/distribution/reference"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// The environment variables with the policy of the provider. A variable which is not empty overrides
+// the setting in the policy document.
+const (
+	policyDocumentVariable           = "POLICY_DOCUMENT"
+	policyAllowedSourcesVariable     = "POLICY_ALLOWED_SOURCES"
+	policyDeniedRepositoriesVariable = "POLICY_DENIED_REPOSITORIES"
+	policyRequireDigestVariable      = "POLICY_REQUIRE_DIGEST"
+	sourceMirrorsVariable            = "SOURCE_MIRRORS"
+	sourceMirrorFallbackVariable     = "SOURCE_MIRROR_FALLBACK"
+)
+
+// policy restricts the images the provider copies, and where it pulls them from, for every resource.
+type policy struct {
+	// AllowedSources are the registries or namespaces images may be copied from, like docker.io/library.
+	// A pattern matches the name of the source repository or a parent path of it. Empty allows any source.
+	AllowedSources []string
+	// DeniedRepositories are the patterns of source repositories which may not be copied.
+	DeniedRepositories []string
+	// RequireDigest requires the ImageReference to contain a digest.
+	RequireDigest bool
+	// Mirrors maps a registry or namespace to the repository prefix of its mirror, like docker.io to
+	// 123456789012.dkr.ecr.eu-west-1.amazonaws.com/docker-hub. The image is pulled from the mirror.
+	Mirrors map[string]string
+	// MirrorFallback pulls the image from the source registry if the pull from the mirror fails.
+	MirrorFallback bool
+}
+
+var s3URIPattern = regexp.MustCompile(`^s3://([^/]+)/(.+)$`)
+
+// loadPolicy returns the policy of the provider from the policy document and the environment variables.
+// The document is read from an SSM parameter, as ssm:<name>, or from S3, as s3://<bucket>/<key>.
+func loadPolicy(ssmService ssmiface.SSMAPI, s3Service s3iface.S3API) (*policy, error) {
+	result := &policy{}
+	if location := os.Getenv(policyDocumentVariable); location != "" {
+		document, err := readPolicyDocument(ssmService, s3Service, location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the policy document %s, %w", location, err)
+		}
+		if err = json.Unmarshal(document, result); err != nil {
+			return nil, fmt.Errorf("the policy document %s is invalid, %w", location, err)
+		}
+	}
+
+	if value := os.Getenv(policyAllowedSourcesVariable); value != "" {
+		result.AllowedSources = splitList(value)
+	}
+	if value := os.Getenv(policyDeniedRepositoriesVariable); value != "" {
+		result.DeniedRepositories = splitList(value)
+	}
+	if value := os.Getenv(policyRequireDigestVariable); value != "" {
+		var ok bool
+		if result.RequireDigest, ok = getBool(value); !ok {
+			return nil, fmt.Errorf("%s is not a boolean", policyRequireDigestVariable)
+		}
+	}
+
+	if value := os.Getenv(sourceMirrorsVariable); value != "" {
+		result.Mirrors = make(map[string]string)
+		for _, rule := range splitList(value) {
+			prefix, mirror, ok := strings.Cut(rule, "=")
+			if !ok {
+				return nil, fmt.Errorf("%s contains %q, which is not <registry or namespace>=<mirror>", sourceMirrorsVariable, rule)
+			}
+			result.Mirrors[strings.TrimSpace(prefix)] = strings.TrimSpace(mirror)
+		}
+	}
+	if value := os.Getenv(sourceMirrorFallbackVariable); value != "" {
+		var ok bool
+		if result.MirrorFallback, ok = getBool(value); !ok {
+			return nil, fmt.Errorf("%s is not a boolean", sourceMirrorFallbackVariable)
+		}
+	}
+	for prefix, mirror := range result.Mirrors {
+		if _, err := name.NewRepository(mirror); err != nil || prefix == "" {
+			return nil, fmt.Errorf("invalid mirror %q for %q", mirror, prefix)
+		}
+	}
+
+	for _, pattern := range append(append([]string{}, result.AllowedSources...), result.DeniedRepositories...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid policy pattern %q, %w", pattern, err)
+		}
+	}
+	return result, nil
+}
+
+// getProviderPolicy loads the policy of the provider. It is loaded on every create and update, so a
+// change of the policy document applies to the next request.
+func getProviderPolicy(awsSession client.ConfigProvider) (*policy, error) {
+	return loadPolicy(ssm.New(awsSession), s3.New(awsSession))
+}
+
+// readPolicyDocument returns the content of the policy document at the location.
+func readPolicyDocument(ssmService ssmiface.SSMAPI, s3Service s3iface.S3API, location string) ([]byte, error) {
+	if parameter, ok := strings.CutPrefix(location, "ssm:"); ok {
+		response, err := ssmService.GetParameter(&ssm.GetParameterInput{Name: aws.String(parameter), WithDecryption: aws.Bool(true)})
+		if err != nil {
+			return nil, err
+		}
+		if response.Parameter == nil || response.Parameter.Value == nil {
+			return nil, fmt.Errorf("the parameter has no value")
+		}
+		return []byte(*response.Parameter.Value), nil
+	}
+
+	if matches := s3URIPattern.FindStringSubmatch(location); matches != nil {
+		response, err := s3Service.GetObject(&s3.GetObjectInput{Bucket: aws.String(matches[1]), Key: aws.String(matches[2])})
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		return io.ReadAll(response.Body)
+	}
+	return nil, fmt.Errorf("the location is not ssm:<parameter> or s3://<bucket>/<key>")
+}
+
+// splitList returns the non-empty, comma separated values.
+func splitList(value string) []string {
+	result := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// check returns an error naming the rule of the policy the properties violate.
+func (p *policy) check(properties *resourceProperties) error {
+	if p == nil {
+		return nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(properties.SourceName)
+	if err != nil {
+		return fmt.Errorf("invalid ImageReference %s, %s", properties.SourceName, err)
+	}
+	sourceName := named.Name()
+
+	if len(p.AllowedSources) > 0 && findPattern(p.AllowedSources, sourceName, true) == "" {
+		return fmt.Errorf("ImageReference %s violates the policy AllowedSources, %s is not in %s", properties.Source, sourceName, strings.Join(p.AllowedSources, ", "))
+	}
+	if pattern := findPattern(p.DeniedRepositories, sourceName, false); pattern != "" {
+		return fmt.Errorf("ImageReference %s violates the policy DeniedRepositories, %s is denied by %s", properties.Source, sourceName, pattern)
+	}
+	if p.RequireDigest && properties.SourceDigest == "" {
+		return fmt.Errorf("ImageReference %s violates the policy RequireDigest, it does not contain a digest", properties.Source)
+	}
+	return nil
+}
+
+// apply sets the mirror of the source.
+func (p *policy) apply(properties *resourceProperties) (err error) {
+	if properties.Mirror, err = p.getMirror(properties); err != nil {
+		return err
+	}
+	if properties.Mirror != nil {
+		properties.MirrorFallback = p.MirrorFallback
+	}
+	return nil
+}
+
+// getMirror returns the reference of the source in the mirror of the longest matching registry or
+// namespace, or nil if the source is not mirrored.
+func (p *policy) getMirror(properties *resourceProperties) (name.Reference, error) {
+	if p == nil || len(p.Mirrors) == 0 {
+		return nil, nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(properties.SourceName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ImageReference %s, %s", properties.SourceName, err)
+	}
+	sourceName := named.Name()
+
+	prefix := ""
+	for candidate := range p.Mirrors {
+		if (sourceName == candidate || strings.HasPrefix(sourceName, candidate+"/")) && len(candidate) > len(prefix) {
+			prefix = candidate
+		}
+	}
+	if prefix == "" {
+		return nil, nil
+	}
+
+	repository, err := name.NewRepository(strings.TrimSuffix(p.Mirrors[prefix], "/") + strings.TrimPrefix(sourceName, prefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror of %s, %s", sourceName, err)
+	}
+	return retarget(properties.Source, repository), nil
+}
+
+// findPattern returns the first pattern that matches the repository name, or an empty string. With
+// parents, a pattern also matches if it matches a parent path of the name.
+func findPattern(patterns []string, repositoryName string, parents bool) string {
+	segments := strings.Split(repositoryName, "/")
+	for _, pattern := range patterns {
+		for i := len(segments); i > 0; i-- {
+			if matched, _ := path.Match(pattern, strings.Join(segments[:i], "/")); matched {
+				return pattern
+			}
+			if !parents {
+				break
+			}
+		}
+	}
+	return ""
+}
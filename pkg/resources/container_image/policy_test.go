@@ -0,0 +1,152 @@
+package container_image
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// fakePolicyStore returns the policy document from an SSM parameter or an S3 object.
+type fakePolicyStore struct {
+	ssmiface.SSMAPI
+	s3iface.S3API
+	documents map[string]string
+}
+
+func (f *fakePolicyStore) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	if document, ok := f.documents["ssm:"+aws.StringValue(input.Name)]; ok {
+		return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Value: aws.String(document)}}, nil
+	}
+	return nil, fmt.Errorf("ParameterNotFound")
+}
+
+func (f *fakePolicyStore) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if document, ok := f.documents[fmt.Sprintf("s3://%s/%s", aws.StringValue(input.Bucket), aws.StringValue(input.Key))]; ok {
+		return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(document))}, nil
+	}
+	return nil, fmt.Errorf("NoSuchKey")
+}
+
+func Test_loadPolicy(t *testing.T) {
+	store := &fakePolicyStore{documents: map[string]string{
+		"ssm:/container-image-provider/policy": `{"AllowedSources": ["docker.io/library"], "RequireDigest": true}`,
+		"s3://policies/container-image.json":   `{"DeniedRepositories": ["docker.io/library/ubuntu"]}`,
+		"ssm:invalid":                          `{"AllowedSources": "docker.io"}`,
+	}}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    *policy
+		wantErr bool
+	}{
+		{name: "no policy", want: &policy{}},
+		{name: "environment", env: map[string]string{"POLICY_ALLOWED_SOURCES": "docker.io/library, ghcr.io/binxio", "POLICY_DENIED_REPOSITORIES": "docker.io/library/ubuntu", "POLICY_REQUIRE_DIGEST": "true"},
+			want: &policy{AllowedSources: []string{"docker.io/library", "ghcr.io/binxio"}, DeniedRepositories: []string{"docker.io/library/ubuntu"}, RequireDigest: true}},
+		{name: "ssm", env: map[string]string{"POLICY_DOCUMENT": "ssm:/container-image-provider/policy"},
+			want: &policy{AllowedSources: []string{"docker.io/library"}, RequireDigest: true}},
+		{name: "s3", env: map[string]string{"POLICY_DOCUMENT": "s3://policies/container-image.json"},
+			want: &policy{DeniedRepositories: []string{"docker.io/library/ubuntu"}}},
+		{name: "environment overrides document", env: map[string]string{"POLICY_DOCUMENT": "ssm:/container-image-provider/policy", "POLICY_REQUIRE_DIGEST": "false"},
+			want: &policy{AllowedSources: []string{"docker.io/library"}}},
+		{name: "missing document", env: map[string]string{"POLICY_DOCUMENT": "ssm:/missing"}, wantErr: true},
+		{name: "invalid document", env: map[string]string{"POLICY_DOCUMENT": "ssm:invalid"}, wantErr: true},
+		{name: "invalid location", env: map[string]string{"POLICY_DOCUMENT": "https://example.com/policy.json"}, wantErr: true},
+		{name: "invalid boolean", env: map[string]string{"POLICY_REQUIRE_DIGEST": "sometimes"}, wantErr: true},
+		{name: "invalid pattern", env: map[string]string{"POLICY_ALLOWED_SOURCES": "docker.io/[library"}, wantErr: true},
+		{name: "mirrors", env: map[string]string{"SOURCE_MIRRORS": "docker.io=123456789012.dkr.ecr.eu-west-1.amazonaws.com/docker-hub, ghcr.io = mirror.example.com/ghcr", "SOURCE_MIRROR_FALLBACK": "true"},
+			want: &policy{Mirrors: map[string]string{"docker.io": "123456789012.dkr.ecr.eu-west-1.amazonaws.com/docker-hub", "ghcr.io": "mirror.example.com/ghcr"}, MirrorFallback: true}},
+		{name: "malformed mirror", env: map[string]string{"SOURCE_MIRRORS": "docker.io"}, wantErr: true},
+		{name: "invalid mirror", env: map[string]string{"SOURCE_MIRRORS": "docker.io=Mirror.example.com/Docker"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{policyDocumentVariable, policyAllowedSourcesVariable, policyDeniedRepositoriesVariable, policyRequireDigestVariable, sourceMirrorsVariable, sourceMirrorFallbackVariable} {
+				t.Setenv(name, tt.env[name])
+			}
+			got, err := loadPolicy(store, store)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadPolicy() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_policy_check(t *testing.T) {
+	p := &policy{
+		AllowedSources:     []string{"docker.io/library", "ghcr.io/binxio", "*.dkr.ecr.*.amazonaws.com"},
+		DeniedRepositories: []string{"docker.io/library/ubuntu", "ghcr.io/binxio/*-dev"},
+	}
+	tests := []struct {
+		imageReference string
+		policy         *policy
+		wantErr        string
+	}{
+		{imageReference: "python:3.9", policy: p},
+		{imageReference: "docker.io/library/python:3.9", policy: p},
+		{imageReference: "ghcr.io/binxio/tools/python:3.9", policy: p},
+		{imageReference: "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9", policy: p},
+		{imageReference: "python:3.9"},
+		{imageReference: "ghcr.io/binxiotools/python:3.9", policy: p, wantErr: "ImageReference ghcr.io/binxiotools/python:3.9 violates the policy AllowedSources, ghcr.io/binxiotools/python is not in docker.io/library, ghcr.io/binxio, *.dkr.ecr.*.amazonaws.com"},
+		{imageReference: "mesosphere/aws-cli:latest", policy: p, wantErr: "ImageReference mesosphere/aws-cli:latest violates the policy AllowedSources, docker.io/mesosphere/aws-cli is not in docker.io/library, ghcr.io/binxio, *.dkr.ecr.*.amazonaws.com"},
+		{imageReference: "ubuntu:22.04", policy: p, wantErr: "ImageReference ubuntu:22.04 violates the policy DeniedRepositories, docker.io/library/ubuntu is denied by docker.io/library/ubuntu"},
+		{imageReference: "ghcr.io/binxio/python-dev:3.9", policy: p, wantErr: "ImageReference ghcr.io/binxio/python-dev:3.9 violates the policy DeniedRepositories, ghcr.io/binxio/python-dev is denied by ghcr.io/binxio/*-dev"},
+		{imageReference: "python:3.9", policy: &policy{RequireDigest: true}, wantErr: "ImageReference python:3.9 violates the policy RequireDigest, it does not contain a digest"},
+		{imageReference: "python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659", policy: &policy{RequireDigest: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.imageReference, func(t *testing.T) {
+			_, err := validate(cfn.Event{
+				ResourceProperties: map[string]interface{}{
+					"ImageReference": tt.imageReference,
+					"RepositoryArn":  "arn:aws:ecr:eu-central-1:444093529715:repository/python",
+				},
+			}, tt.policy)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_policy_getMirror(t *testing.T) {
+	p := &policy{Mirrors: map[string]string{
+		"docker.io":         "123456789012.dkr.ecr.eu-west-1.amazonaws.com/docker-hub",
+		"docker.io/binxio":  "123456789012.dkr.ecr.eu-west-1.amazonaws.com/binxio/",
+		"ghcr.io/binxio":    "mirror.example.com/ghcr",
+		"quay.io/prometheu": "mirror.example.com/quay",
+	}}
+	tests := []struct {
+		imageReference string
+		want           string
+	}{
+		{imageReference: "python:3.9", want: "123456789012.dkr.ecr.eu-west-1.amazonaws.com/docker-hub/library/python:3.9"},
+		{imageReference: "docker.io/binxio/cfn-container-image-provider:1.0.0", want: "123456789012.dkr.ecr.eu-west-1.amazonaws.com/binxio/cfn-container-image-provider:1.0.0"},
+		{imageReference: "ghcr.io/binxio/python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659", want: "mirror.example.com/ghcr/python@sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659"},
+		{imageReference: "ghcr.io/binxiotools/python:3.9"},
+		{imageReference: "quay.io/prometheus/node-exporter:v1.6.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.imageReference, func(t *testing.T) {
+			properties := &resourceProperties{SourceName: tt.imageReference, Source: mustParse(tt.imageReference)}
+			got, err := p.getMirror(properties)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil && tt.want != "") || (got != nil && got.String() != tt.want) {
+				t.Errorf("getMirror() = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package container_image
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// The suffixes of the tags in the cosign tag schema, which attach signatures, attestations and SBOMs to an image.
+const (
+	cosignSignatureSuffix   = ".sig"
+	cosignAttestationSuffix = ".att"
+	cosignSBOMSuffix        = ".sbom"
+)
+
+// getCosignReference returns the tag in the cosign tag schema with the suffix, for the image with the digest.
+func getCosignReference(repository name.Repository, digest v1.Hash, suffix string) name.Tag {
+	return repository.Tag(fmt.Sprintf("%s-%s%s", digest.Algorithm, digest.Hex, suffix))
+}
+
+// referrer is an artifact attached to the image. An OCI referrer refers to the image by its subject, a
+// cosign artifact is attached by the tag.
+type referrer struct {
+	artifact *remote.Descriptor
+	tag      string
+}
+
+// getReferrers returns the artifacts attached to the image with the digest in the repository. OCI referrers
+// are found through the referrers API, or its tag schema fallback, and cosign artifacts through the
+// cosign tag schema.
+func getReferrers(repository name.Repository, digest v1.Hash, options []remote.Option) ([]referrer, error) {
+	subject := repository.Digest(digest.String())
+	index, err := remote.Referrers(subject, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the referrers of %s: %w", subject, err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the referrers of %s: %w", subject, err)
+	}
+
+	result := make([]referrer, 0, len(manifest.Manifests))
+	for _, descriptor := range manifest.Manifests {
+		artifact, err := remote.Get(repository.Digest(descriptor.Digest.String()), options...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the referrer %s of %s: %w", descriptor.Digest, subject, err)
+		}
+		result = append(result, referrer{artifact: artifact})
+	}
+
+	for _, suffix := range []string{cosignSignatureSuffix, cosignAttestationSuffix, cosignSBOMSuffix} {
+		tag := getCosignReference(repository, digest, suffix)
+		artifact, err := remote.Get(tag, options...)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s: %w", tag, err)
+		}
+		result = append(result, referrer{artifact: artifact, tag: tag.TagStr()})
+	}
+	return result, nil
+}
+
+// isNotFound returns true if the error is a registry response that the manifest does not exist.
+func isNotFound(err error) bool {
+	var transportError *transport.Error
+	return errors.As(err, &transportError) && transportError.StatusCode == http.StatusNotFound
+}
+
+// getReferrerDigests returns the digests of the referrers of the image.
+func (image *sourceImage) getReferrerDigests() []string {
+	result := make([]string, 0, len(image.referrers))
+	for _, referrer := range image.referrers {
+		if digest := referrer.artifact.Digest.String(); !contains(result, digest) {
+			result = append(result, digest)
+		}
+	}
+	return result
+}
+
+// getReferrerReference returns the reference to push the referrer to in the repository.
+func (r referrer) getReferrerReference(repository name.Repository) name.Reference {
+	if r.tag != "" {
+		return repository.Tag(r.tag)
+	}
+	return repository.Digest(r.artifact.Digest.String())
+}
@@ -0,0 +1,88 @@
+package container_image
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func Test_copyReferrers(t *testing.T) {
+	host := newTestRegistry(t)
+
+	source := mustParse(host + "/library/python:3.9")
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remote.Write(source, image); err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := image.Digest()
+	mediaType, _ := image.MediaType()
+	size, _ := image.Size()
+
+	// an SBOM attached as OCI referrer, and a cosign signature attached by tag
+	sbom, err := mutate.Append(empty.Image, mutate.Addendum{Layer: static.NewLayer([]byte(`{"spdxVersion":"SPDX-2.3"}`), "application/spdx+json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbom = mutate.ConfigMediaType(mutate.MediaType(sbom, types.OCIManifestSchema1), "application/spdx+json")
+	sbom = mutate.Subject(sbom, v1.Descriptor{MediaType: mediaType, Size: size, Digest: digest}).(v1.Image)
+	sbomDigest, _ := sbom.Digest()
+	if err = remote.Write(source.Context().Digest(sbomDigest.String()), sbom); err != nil {
+		t.Fatal(err)
+	}
+	mustSign(t, source.Context(), digest, digest.String(), mustGenerateKey(t), nil)
+	signature, err := remote.Head(getCosignReference(source.Context(), digest, cosignSignatureSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		copyReferrers bool
+		want          []string
+	}{
+		{name: "without referrers", want: []string{}},
+		{name: "with referrers", copyReferrers: true, want: []string{sbomDigest.String(), signature.Digest.String()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			properties := &resourceProperties{
+				Source:        source,
+				Target:        mustParse(host + "/" + strings.ReplaceAll(tt.name, " ", "-") + "/python:3.9"),
+				CopyReferrers: tt.copyReferrers,
+			}
+			data, err := copyImage(context.Background(), properties, nil, nil, nil, []targetRegistry{&genericTargetRegistry{}}, registryRetryPolicy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(data["Referrers"], tt.want) {
+				t.Errorf("copyImage() Referrers = %v, want %v", data["Referrers"], tt.want)
+			}
+
+			target := properties.Target.Context()
+			_, err = remote.Head(getCosignReference(target, digest, cosignSignatureSuffix))
+			if copied := err == nil; copied != tt.copyReferrers {
+				t.Errorf("copyImage() copied signature = %v, want %v", copied, tt.copyReferrers)
+			}
+			referrers, err := remote.Referrers(target.Digest(digest.String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifest, _ := referrers.IndexManifest()
+			if copied := len(manifest.Manifests) == 1 && manifest.Manifests[0].Digest == sbomDigest; copied != tt.copyReferrers {
+				t.Errorf("copyImage() referrers of the target = %v, want the SBOM %v", manifest.Manifests, tt.copyReferrers)
+			}
+		})
+	}
+}
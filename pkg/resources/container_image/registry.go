@@ -0,0 +1,155 @@
+package container_image
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// targetRegistry is the registry the image is copied to.
+type targetRegistry interface {
+	// authenticator returns the authenticator to push to and delete from the registry.
+	authenticator() (authn.Authenticator, error)
+	// untag removes the reference from the image with the digest.
+	untag(imageReference name.Reference, digest v1.Hash, options []remote.Option) deleteOutcome
+	// tags returns the tags in the repository which point to the digest.
+	tags(repository name.Repository, digest v1.Hash, options []remote.Option) ([]string, error)
+}
+
+// newTargetRegistry returns the registry of the target reference. An ECR registry is accessed with an ECR
+// authorization token, any other registry with the credentials in the secret, or anonymously.
+func newTargetRegistry(awsSession client.ConfigProvider, target name.Reference, secretArn string, roleArn string) targetRegistry {
+	if registry, ok := parseECRRegistry(target.Context().RegistryStr()); ok {
+		return &ecrTargetRegistry{
+			svc:        newECRService(awsSession, registry.region, roleArn, registry.fips),
+			registryID: registry.accountID,
+		}
+	}
+	if secretArn != "" {
+		return &genericTargetRegistry{svc: secretsmanager.New(awsSession), secretArn: secretArn}
+	}
+	return &genericTargetRegistry{}
+}
+
+// ecrTargetRegistry is an ECR registry.
+type ecrTargetRegistry struct {
+	svc        ecriface.ECRAPI
+	registryID string
+}
+
+func (r *ecrTargetRegistry) authenticator() (authn.Authenticator, error) {
+	return getAuthentication(r.svc)
+}
+
+// untag removes the tag from the image with the digest in a single ECR call, which fails if the tag was
+// moved to another image in the meantime. ECR removes the image itself once no other tag points to it.
+// A digest reference deletes the image.
+func (r *ecrTargetRegistry) untag(imageReference name.Reference, digest v1.Hash, _ []remote.Option) deleteOutcome {
+	imageID := &ecr.ImageIdentifier{ImageDigest: aws.String(digest.String())}
+	if tag, ok := imageReference.(name.Tag); ok {
+		imageID.ImageTag = aws.String(tag.TagStr())
+	}
+
+	input := &ecr.BatchDeleteImageInput{
+		RepositoryName: aws.String(imageReference.Context().RepositoryStr()),
+		ImageIds:       []*ecr.ImageIdentifier{imageID},
+	}
+	if r.registryID != "" {
+		input.RegistryId = aws.String(r.registryID)
+	}
+
+	response, err := r.svc.BatchDeleteImage(input)
+	if err != nil {
+		return deleteOutcome{Outcome: outcomeFailed, Reason: err.Error()}
+	}
+
+	for _, failure := range response.Failures {
+		reason := aws.StringValue(failure.FailureReason)
+		switch aws.StringValue(failure.FailureCode) {
+		case ecr.ImageFailureCodeImageNotFound:
+			return deleteOutcome{Outcome: outcomeIgnored, Reason: fmt.Sprintf("image not found, %s", reason)}
+		case ecr.ImageFailureCodeImageTagDoesNotMatchDigest:
+			return deleteOutcome{Outcome: outcomeRetained, Reason: fmt.Sprintf("the image no longer points to %s, %s", digest, reason)}
+		default:
+			return deleteOutcome{Outcome: outcomeFailed, Reason: fmt.Sprintf("%s, %s", aws.StringValue(failure.FailureCode), reason)}
+		}
+	}
+	return deleteOutcome{Outcome: outcomeDeleted}
+}
+
+// tags lists the tagged images of the repository, a page of images per ECR call.
+func (r *ecrTargetRegistry) tags(repository name.Repository, digest v1.Hash, _ []remote.Option) ([]string, error) {
+	input := &ecr.ListImagesInput{
+		RepositoryName: aws.String(repository.RepositoryStr()),
+		Filter:         &ecr.ListImagesFilter{TagStatus: aws.String(ecr.TagStatusTagged)},
+	}
+	if r.registryID != "" {
+		input.RegistryId = aws.String(r.registryID)
+	}
+
+	result := make([]string, 0)
+	err := r.svc.ListImagesPages(input, func(page *ecr.ListImagesOutput, _ bool) bool {
+		for _, imageID := range page.ImageIds {
+			if aws.StringValue(imageID.ImageDigest) == digest.String() {
+				result = append(result, aws.StringValue(imageID.ImageTag))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// genericTargetRegistry is any other registry, accessed with the credentials in a secret or anonymously.
+type genericTargetRegistry struct {
+	svc       secretsmanageriface.SecretsManagerAPI
+	secretArn string
+}
+
+func (r *genericTargetRegistry) authenticator() (authn.Authenticator, error) {
+	if r.secretArn == "" {
+		return authn.Anonymous, nil
+	}
+	return getSecretAuthentication(r.svc, r.secretArn)
+}
+
+// untag deletes the reference through the registry API. What is removed depends on the registry: some
+// only remove the tag, others the manifest it points to. A reference to the image of the replacement of
+// the resource is therefore never passed to untag, see deleteReference.
+func (r *genericTargetRegistry) untag(imageReference name.Reference, digest v1.Hash, options []remote.Option) deleteOutcome {
+	if err := remote.Delete(imageReference, options...); err != nil {
+		return deleteOutcome{Outcome: outcomeFailed, Reason: err.Error()}
+	}
+	return deleteOutcome{Outcome: outcomeDeleted}
+}
+
+// tags lists the tags of the repository, and resolves each of them to its digest.
+func (r *genericTargetRegistry) tags(repository name.Repository, digest v1.Hash, options []remote.Option) ([]string, error) {
+	tags, err := remote.List(repository, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0)
+	for _, tag := range tags {
+		descriptor, err := remote.Head(repository.Tag(tag), options...)
+		if err != nil {
+			return nil, err
+		}
+		if descriptor.Digest == digest {
+			result = append(result, tag)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,47 @@
+package container_image
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+func Test_newTargetRegistry(t *testing.T) {
+	awsSession := session.Must(session.NewSession(aws.NewConfig().WithRegion("eu-central-1")))
+
+	registry := newTargetRegistry(awsSession, mustParse("444093529715.dkr.ecr.eu-west-1.amazonaws.com/python:3.9"), "", "")
+	if ecrRegistry, ok := registry.(*ecrTargetRegistry); !ok || ecrRegistry.registryID != "444093529715" {
+		t.Errorf("newTargetRegistry() = %v, want the ECR registry of 444093529715", registry)
+	}
+
+	registry = newTargetRegistry(awsSession, mustParse("ghcr.io/binxio/python:3.9"), "arn:aws:secretsmanager:eu-central-1:444093529715:secret:ghcr", "")
+	if genericRegistry, ok := registry.(*genericTargetRegistry); !ok || genericRegistry.secretArn == "" {
+		t.Errorf("newTargetRegistry() = %v, want a registry with credentials from the secret", registry)
+	}
+
+	registry = newTargetRegistry(awsSession, mustParse("localhost:5000/python:3.9"), "", "")
+	if _, ok := registry.(*genericTargetRegistry); !ok {
+		t.Errorf("newTargetRegistry() = %v, want an anonymous registry", registry)
+	}
+}
+
+func Test_genericTargetRegistry_authenticator(t *testing.T) {
+	registry := &genericTargetRegistry{
+		svc:       &fakeSecretsManager{secrets: map[string]string{"ghcr": `{"username": "binxio", "password": "s3cr3t"}`}},
+		secretArn: "ghcr",
+	}
+	got, err := registry.authenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&authn.Basic{Username: "binxio", Password: "s3cr3t"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("authenticator() got = %v, want %v", got, want)
+	}
+
+	if got, err = (&genericTargetRegistry{}).authenticator(); err != nil || got != authn.Anonymous {
+		t.Errorf("authenticator() got = %v, %v, want anonymous", got, err)
+	}
+}
@@ -0,0 +1,288 @@
+package container_image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+)
+
+// createdByTagKey is the tag on a repository created by the provider, with the resource that created it as value.
+const createdByTagKey = "cfn-container-image-provider:created-by"
+
+// repositoryNameComponentPattern is a component of a segment of an ECR repository name: lowercase letters and
+// digits, separated by a single period, underscore or hyphen.
+var repositoryNameComponentPattern = regexp.MustCompile(`^[a-z\d]+(?:[._-][a-z\d]+)*$`)
+
+// validateRepositoryName returns an error naming the offending segment if the name is not a valid ECR
+// repository name. A name is 2 to 256 characters long, and consists of one or more segments separated
+// by a single forward slash.
+func validateRepositoryName(repositoryName string) error {
+	if len(repositoryName) < 2 || len(repositoryName) > 256 {
+		return fmt.Errorf("repository name %q must be 2 to 256 characters long", repositoryName)
+	}
+	for i, segment := range strings.Split(repositoryName, "/") {
+		if segment == "" {
+			return fmt.Errorf("repository name %q has an empty segment at position %d", repositoryName, i+1)
+		}
+		if !repositoryNameComponentPattern.MatchString(segment) {
+			return fmt.Errorf("repository name %q has an invalid segment %q, it must consist of lowercase letters and digits separated by a single period, underscore or hyphen", repositoryName, segment)
+		}
+	}
+	return nil
+}
+
+// repositoryConfiguration is the configuration of a target repository which is created when it does not exist.
+type repositoryConfiguration struct {
+	ScanOnPush          bool
+	ImageTagMutability  string
+	EncryptionType      string
+	KmsKey              string
+	LifecyclePolicyText string
+}
+
+// getRepositoryConfiguration returns the configuration of the repository to create, or nil if CreateRepository is not true.
+func getRepositoryConfiguration(properties map[string]interface{}) (*repositoryConfiguration, error) {
+	createRepository := false
+	if value, ok := properties["CreateRepository"]; ok {
+		if createRepository, ok = getBool(value); !ok {
+			return nil, fmt.Errorf("CreateRepository is not a boolean")
+		}
+	}
+
+	if !createRepository {
+		for _, name := range []string{"ScanOnPush", "ImageTagMutability", "EncryptionType", "KmsKey", "LifecyclePolicy"} {
+			if _, ok := properties[name]; ok {
+				return nil, fmt.Errorf("%s requires CreateRepository", name)
+			}
+		}
+		return nil, nil
+	}
+
+	result := &repositoryConfiguration{}
+	if value, ok := properties["ScanOnPush"]; ok {
+		if result.ScanOnPush, ok = getBool(value); !ok {
+			return nil, fmt.Errorf("ScanOnPush is not a boolean")
+		}
+	}
+
+	if value, ok := properties["ImageTagMutability"]; ok {
+		mutability, _ := value.(string)
+		switch strings.ToUpper(mutability) {
+		case ecr.ImageTagMutabilityMutable, ecr.ImageTagMutabilityImmutable:
+			result.ImageTagMutability = strings.ToUpper(mutability)
+		default:
+			return nil, fmt.Errorf("ImageTagMutability must be %s or %s", ecr.ImageTagMutabilityMutable, ecr.ImageTagMutabilityImmutable)
+		}
+	}
+
+	if value, ok := properties["EncryptionType"]; ok {
+		encryptionType, _ := value.(string)
+		switch strings.ToUpper(encryptionType) {
+		case ecr.EncryptionTypeAes256, ecr.EncryptionTypeKms:
+			result.EncryptionType = strings.ToUpper(encryptionType)
+		default:
+			return nil, fmt.Errorf("EncryptionType must be %s or %s", ecr.EncryptionTypeAes256, ecr.EncryptionTypeKms)
+		}
+	}
+
+	if value, ok := properties["KmsKey"]; ok {
+		if result.KmsKey, ok = value.(string); !ok || result.KmsKey == "" {
+			return nil, fmt.Errorf("KmsKey is not a string")
+		}
+		if result.EncryptionType != ecr.EncryptionTypeKms {
+			return nil, fmt.Errorf("KmsKey requires EncryptionType %s", ecr.EncryptionTypeKms)
+		}
+	}
+
+	if value, ok := properties["LifecyclePolicy"]; ok {
+		switch policy := value.(type) {
+		case string:
+			if !json.Valid([]byte(policy)) {
+				return nil, fmt.Errorf("LifecyclePolicy is not valid JSON")
+			}
+			result.LifecyclePolicyText = policy
+		case map[string]interface{}:
+			text, err := json.Marshal(getLifecyclePolicyNumbers(policy))
+			if err != nil {
+				return nil, fmt.Errorf("LifecyclePolicy is not valid JSON, %s", err)
+			}
+			result.LifecyclePolicyText = string(text)
+		default:
+			return nil, fmt.Errorf("LifecyclePolicy is not a string or an object")
+		}
+	}
+	return result, nil
+}
+
+// lifecyclePolicyNumbers are the numeric fields of a lifecycle policy rule, which CloudFormation passes as strings.
+var lifecyclePolicyNumbers = map[string]bool{"rulePriority": true, "countNumber": true}
+
+// getLifecyclePolicyNumbers returns the lifecycle policy with the numeric fields converted back to numbers.
+func getLifecyclePolicyNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			if s, ok := element.(string); ok && lifecyclePolicyNumbers[key] {
+				if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+					result[key] = n
+					continue
+				}
+			}
+			result[key] = getLifecyclePolicyNumbers(element)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, element := range v {
+			result[i] = getLifecyclePolicyNumbers(element)
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+// getBool returns the value of a boolean property, which CloudFormation passes as a string.
+func getBool(value interface{}) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	default:
+		return false, false
+	}
+}
+
+// getCreatedBy returns the value of the created-by tag of a repository created for the resource.
+func getCreatedBy(event cfn.Event) string {
+	return event.StackID + "/" + event.LogicalResourceID
+}
+
+func isAWSError(err error, code string) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == code
+}
+
+// ensureRepository creates the target repository when it does not exist.
+func ensureRepository(svc ecriface.ECRAPI, properties *resourceProperties, createdBy string) error {
+	_, err := svc.DescribeRepositories(&ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(properties.AccountID),
+		RepositoryNames: aws.StringSlice([]string{properties.RepositoryName}),
+	})
+	if err == nil {
+		return nil
+	}
+	if !isAWSError(err, ecr.ErrCodeRepositoryNotFoundException) {
+		return fmt.Errorf("failed to describe repository %s, %w", properties.RepositoryName, err)
+	}
+
+	configuration := properties.CreateRepository
+	input := &ecr.CreateRepositoryInput{
+		RegistryId:                 aws.String(properties.AccountID),
+		RepositoryName:             aws.String(properties.RepositoryName),
+		ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(configuration.ScanOnPush)},
+		Tags:                       []*ecr.Tag{{Key: aws.String(createdByTagKey), Value: aws.String(createdBy)}},
+	}
+	if configuration.ImageTagMutability != "" {
+		input.ImageTagMutability = aws.String(configuration.ImageTagMutability)
+	}
+	if configuration.EncryptionType != "" {
+		input.EncryptionConfiguration = &ecr.EncryptionConfiguration{EncryptionType: aws.String(configuration.EncryptionType)}
+		if configuration.KmsKey != "" {
+			input.EncryptionConfiguration.KmsKey = aws.String(configuration.KmsKey)
+		}
+	}
+
+	if _, err = svc.CreateRepository(input); err != nil {
+		if isAWSError(err, ecr.ErrCodeRepositoryAlreadyExistsException) {
+			return nil
+		}
+		return fmt.Errorf("failed to create repository %s, %w", properties.RepositoryName, err)
+	}
+	log.Printf("created repository %s", properties.RepositoryName)
+
+	if configuration.LifecyclePolicyText != "" {
+		if _, err = svc.PutLifecyclePolicy(&ecr.PutLifecyclePolicyInput{
+			RegistryId:          aws.String(properties.AccountID),
+			RepositoryName:      aws.String(properties.RepositoryName),
+			LifecyclePolicyText: aws.String(configuration.LifecyclePolicyText),
+		}); err != nil {
+			return fmt.Errorf("failed to put the lifecycle policy of repository %s, %w", properties.RepositoryName, err)
+		}
+	}
+	return nil
+}
+
+// deleteCreatedRepositories deletes the empty repositories created for the resource, after the image
+// could not be copied to them. The physical resource ID of a failed create does not name the targets, so the
+// delete which follows cannot find them. The services are the ECR clients of the targets of the properties.
+func deleteCreatedRepositories(services []ecriface.ECRAPI, properties *resourceProperties, createdBy string) {
+	for i, target := range properties.getTargets() {
+		targetProperties := properties.withTarget(target)
+		outcome := deleteRepository(services[i], targetProperties.AccountID, targetProperties.RepositoryName, createdBy)
+		outcome.Reference = target.Context().String()
+		outcome.log()
+	}
+}
+
+// deleteRepository deletes the repository if it was created for the resource and is empty.
+func deleteRepository(svc ecriface.ECRAPI, registryID string, repositoryName string, createdBy string) deleteOutcome {
+	repositories, err := svc.DescribeRepositories(&ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(registryID),
+		RepositoryNames: aws.StringSlice([]string{repositoryName}),
+	})
+	if err != nil {
+		if isAWSError(err, ecr.ErrCodeRepositoryNotFoundException) {
+			return deleteOutcome{Outcome: outcomeIgnored, Reason: "repository not found"}
+		}
+		return deleteOutcome{Outcome: outcomeFailed, Reason: err.Error()}
+	}
+	if len(repositories.Repositories) == 0 {
+		return deleteOutcome{Outcome: outcomeIgnored, Reason: "repository not found"}
+	}
+
+	tags, err := svc.ListTagsForResource(&ecr.ListTagsForResourceInput{ResourceArn: repositories.Repositories[0].RepositoryArn})
+	if err != nil {
+		return deleteOutcome{Outcome: outcomeFailed, Reason: err.Error()}
+	}
+	created := false
+	for _, tag := range tags.Tags {
+		created = created || (aws.StringValue(tag.Key) == createdByTagKey && aws.StringValue(tag.Value) == createdBy)
+	}
+	if !created {
+		return deleteOutcome{Outcome: outcomeRetained, Reason: "the repository was not created by this resource"}
+	}
+
+	images, err := svc.ListImages(&ecr.ListImagesInput{
+		RegistryId:     aws.String(registryID),
+		RepositoryName: aws.String(repositoryName),
+		MaxResults:     aws.Int64(1),
+	})
+	if err != nil {
+		return deleteOutcome{Outcome: outcomeFailed, Reason: err.Error()}
+	}
+	if len(images.ImageIds) > 0 {
+		return deleteOutcome{Outcome: outcomeRetained, Reason: "the repository is not empty"}
+	}
+
+	if _, err = svc.DeleteRepository(&ecr.DeleteRepositoryInput{
+		RegistryId:     aws.String(registryID),
+		RepositoryName: aws.String(repositoryName),
+	}); err != nil {
+		return deleteOutcome{Outcome: outcomeFailed, Reason: err.Error()}
+	}
+	return deleteOutcome{Outcome: outcomeDeleted}
+}
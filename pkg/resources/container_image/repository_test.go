@@ -0,0 +1,295 @@
+package container_image
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+type fakeRepository struct {
+	input           *ecr.CreateRepositoryInput
+	tags            []*ecr.Tag
+	images          int
+	lifecyclePolicy string
+	deleted         bool
+}
+
+// fakeRepositoryECR keeps repositories in memory.
+type fakeRepositoryECR struct {
+	ecriface.ECRAPI
+	repositories map[string]*fakeRepository
+}
+
+func (f *fakeRepositoryECR) DescribeRepositories(input *ecr.DescribeRepositoriesInput) (*ecr.DescribeRepositoriesOutput, error) {
+	result := &ecr.DescribeRepositoriesOutput{}
+	for _, name := range aws.StringValueSlice(input.RepositoryNames) {
+		if repository, ok := f.repositories[name]; !ok || repository.deleted {
+			return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, name, nil)
+		}
+		result.Repositories = append(result.Repositories, &ecr.Repository{RepositoryName: aws.String(name), RepositoryArn: aws.String(name)})
+	}
+	return result, nil
+}
+
+func (f *fakeRepositoryECR) CreateRepository(input *ecr.CreateRepositoryInput) (*ecr.CreateRepositoryOutput, error) {
+	name := aws.StringValue(input.RepositoryName)
+	if _, ok := f.repositories[name]; ok {
+		return nil, awserr.New(ecr.ErrCodeRepositoryAlreadyExistsException, name, nil)
+	}
+	f.repositories[name] = &fakeRepository{input: input, tags: input.Tags}
+	return &ecr.CreateRepositoryOutput{Repository: &ecr.Repository{RepositoryName: input.RepositoryName}}, nil
+}
+
+func (f *fakeRepositoryECR) PutLifecyclePolicy(input *ecr.PutLifecyclePolicyInput) (*ecr.PutLifecyclePolicyOutput, error) {
+	f.repositories[aws.StringValue(input.RepositoryName)].lifecyclePolicy = aws.StringValue(input.LifecyclePolicyText)
+	return &ecr.PutLifecyclePolicyOutput{}, nil
+}
+
+func (f *fakeRepositoryECR) ListTagsForResource(input *ecr.ListTagsForResourceInput) (*ecr.ListTagsForResourceOutput, error) {
+	return &ecr.ListTagsForResourceOutput{Tags: f.repositories[aws.StringValue(input.ResourceArn)].tags}, nil
+}
+
+func (f *fakeRepositoryECR) ListImages(input *ecr.ListImagesInput) (*ecr.ListImagesOutput, error) {
+	result := &ecr.ListImagesOutput{}
+	for i := 0; i < f.repositories[aws.StringValue(input.RepositoryName)].images; i++ {
+		result.ImageIds = append(result.ImageIds, &ecr.ImageIdentifier{ImageTag: aws.String("latest")})
+	}
+	return result, nil
+}
+
+func (f *fakeRepositoryECR) DeleteRepository(input *ecr.DeleteRepositoryInput) (*ecr.DeleteRepositoryOutput, error) {
+	f.repositories[aws.StringValue(input.RepositoryName)].deleted = true
+	return &ecr.DeleteRepositoryOutput{}, nil
+}
+
+func Test_validateRepositoryName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{name: "python"},
+		{name: "mirror/library/python"},
+		{name: "py.thon_3-9"},
+		{name: "3rd-party/python"},
+		{name: "p", wantErr: `repository name "p" must be 2 to 256 characters long`},
+		{name: "a-_b", wantErr: `repository name "a-_b" has an invalid segment "a-_b", it must consist of lowercase letters and digits separated by a single period, underscore or hyphen`},
+		{name: "mirror/-python", wantErr: `repository name "mirror/-python" has an invalid segment "-python", it must consist of lowercase letters and digits separated by a single period, underscore or hyphen`},
+		{name: "mirror/Python", wantErr: `repository name "mirror/Python" has an invalid segment "Python", it must consist of lowercase letters and digits separated by a single period, underscore or hyphen`},
+		{name: "mirror//python", wantErr: `repository name "mirror//python" has an empty segment at position 2`},
+		{name: "/python", wantErr: `repository name "/python" has an empty segment at position 1`},
+		{name: "python/", wantErr: `repository name "python/" has an empty segment at position 2`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRepositoryName(tt.name)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("validateRepositoryName() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_getRepositoryConfiguration(t *testing.T) {
+	tests := []struct {
+		name           string
+		properties     map[string]interface{}
+		want           *repositoryConfiguration
+		wantErrMessage string
+	}{
+		{name: "not created", properties: map[string]interface{}{}, want: nil},
+		{name: "false", properties: map[string]interface{}{"CreateRepository": "false"}, want: nil},
+		{name: "defaults", properties: map[string]interface{}{"CreateRepository": "true"}, want: &repositoryConfiguration{}},
+		{
+			name: "all settings",
+			properties: map[string]interface{}{
+				"CreateRepository":   true,
+				"ScanOnPush":         "true",
+				"ImageTagMutability": "immutable",
+				"EncryptionType":     "kms",
+				"KmsKey":             "alias/ecr",
+				"LifecyclePolicy":    map[string]interface{}{"rules": []interface{}{}},
+			},
+			want: &repositoryConfiguration{
+				ScanOnPush:          true,
+				ImageTagMutability:  "IMMUTABLE",
+				EncryptionType:      "KMS",
+				KmsKey:              "alias/ecr",
+				LifecyclePolicyText: `{"rules":[]}`,
+			},
+		},
+		{
+			name: "lifecycle policy rules",
+			properties: map[string]interface{}{
+				"CreateRepository": "true",
+				"LifecyclePolicy": map[string]interface{}{
+					"rules": []interface{}{
+						map[string]interface{}{
+							"rulePriority": "1",
+							"description":  "2",
+							"selection": map[string]interface{}{
+								"tagStatus":     "tagged",
+								"tagPrefixList": []interface{}{"1"},
+								"countType":     "imageCountMoreThan",
+								"countNumber":   "14",
+							},
+							"action": map[string]interface{}{"type": "expire"},
+						},
+					},
+				},
+			},
+			want: &repositoryConfiguration{
+				LifecyclePolicyText: `{"rules":[{"action":{"type":"expire"},"description":"2","rulePriority":1,"selection":{"countNumber":14,"countType":"imageCountMoreThan","tagPrefixList":["1"],"tagStatus":"tagged"}}]}`,
+			},
+		},
+		{
+			name:       "lifecycle policy text",
+			properties: map[string]interface{}{"CreateRepository": "true", "LifecyclePolicy": `{"rules":[]}`},
+			want:       &repositoryConfiguration{LifecyclePolicyText: `{"rules":[]}`},
+		},
+		{
+			name:           "setting without CreateRepository",
+			properties:     map[string]interface{}{"ScanOnPush": "true"},
+			wantErrMessage: "ScanOnPush requires CreateRepository",
+		},
+		{
+			name:           "invalid CreateRepository",
+			properties:     map[string]interface{}{"CreateRepository": "yes please"},
+			wantErrMessage: "CreateRepository is not a boolean",
+		},
+		{
+			name:           "invalid mutability",
+			properties:     map[string]interface{}{"CreateRepository": "true", "ImageTagMutability": "sometimes"},
+			wantErrMessage: "ImageTagMutability must be MUTABLE or IMMUTABLE",
+		},
+		{
+			name:           "KmsKey without KMS",
+			properties:     map[string]interface{}{"CreateRepository": "true", "KmsKey": "alias/ecr"},
+			wantErrMessage: "KmsKey requires EncryptionType KMS",
+		},
+		{
+			name:           "invalid lifecycle policy",
+			properties:     map[string]interface{}{"CreateRepository": "true", "LifecyclePolicy": "{"},
+			wantErrMessage: "LifecyclePolicy is not valid JSON",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getRepositoryConfiguration(tt.properties)
+			if tt.wantErrMessage != "" {
+				if err == nil || err.Error() != tt.wantErrMessage {
+					t.Errorf("getRepositoryConfiguration() error = %v, wantErrMessage %v", err, tt.wantErrMessage)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getRepositoryConfiguration() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ensureRepository(t *testing.T) {
+	svc := &fakeRepositoryECR{repositories: map[string]*fakeRepository{"existing": {}}}
+	properties := &resourceProperties{
+		AccountID:      "444093529715",
+		RepositoryName: "mirror/python",
+		CreateRepository: &repositoryConfiguration{
+			ScanOnPush:          true,
+			ImageTagMutability:  ecr.ImageTagMutabilityImmutable,
+			EncryptionType:      ecr.EncryptionTypeAes256,
+			LifecyclePolicyText: `{"rules":[]}`,
+		},
+	}
+
+	if err := ensureRepository(svc, properties, "stack/Python"); err != nil {
+		t.Fatal(err)
+	}
+	repository, ok := svc.repositories["mirror/python"]
+	if !ok {
+		t.Fatalf("ensureRepository() did not create the repository")
+	}
+	input := repository.input
+	if !aws.BoolValue(input.ImageScanningConfiguration.ScanOnPush) ||
+		aws.StringValue(input.ImageTagMutability) != ecr.ImageTagMutabilityImmutable ||
+		aws.StringValue(input.EncryptionConfiguration.EncryptionType) != ecr.EncryptionTypeAes256 ||
+		repository.lifecyclePolicy != `{"rules":[]}` {
+		t.Errorf("ensureRepository() created %v with lifecycle policy %q", input, repository.lifecyclePolicy)
+	}
+	if len(repository.tags) != 1 || aws.StringValue(repository.tags[0].Value) != "stack/Python" {
+		t.Errorf("ensureRepository() tags = %v, want %s=stack/Python", repository.tags, createdByTagKey)
+	}
+
+	properties.RepositoryName = "existing"
+	if err := ensureRepository(svc, properties, "stack/Python"); err != nil {
+		t.Fatal(err)
+	}
+	if svc.repositories["existing"].input != nil {
+		t.Errorf("ensureRepository() recreated an existing repository")
+	}
+}
+
+func Test_deleteCreatedRepositories(t *testing.T) {
+	createdBy := []*ecr.Tag{{Key: aws.String(createdByTagKey), Value: aws.String("stack/Python")}}
+	svc := &fakeRepositoryECR{repositories: map[string]*fakeRepository{
+		"mirror/python": {tags: createdBy},
+		"other/python":  {},
+	}}
+	properties := &resourceProperties{
+		Target: mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/mirror/python:3.12"),
+		Repositories: []name.Repository{
+			mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/mirror/python").Context(),
+			mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/other/python").Context(),
+		},
+	}
+
+	deleteCreatedRepositories([]ecriface.ECRAPI{svc, svc}, properties, "stack/Python")
+	if !svc.repositories["mirror/python"].deleted {
+		t.Errorf("deleteCreatedRepositories() did not delete the created repository")
+	}
+	if svc.repositories["other/python"].deleted {
+		t.Errorf("deleteCreatedRepositories() deleted a repository which was not created by the resource")
+	}
+}
+
+func Test_deleteRepository(t *testing.T) {
+	createdBy := []*ecr.Tag{{Key: aws.String(createdByTagKey), Value: aws.String("stack/Python")}}
+	tests := []struct {
+		name        string
+		repository  *fakeRepository
+		wantOutcome string
+	}{
+		{name: "created and empty", repository: &fakeRepository{tags: createdBy}, wantOutcome: outcomeDeleted},
+		{name: "created and not empty", repository: &fakeRepository{tags: createdBy, images: 1}, wantOutcome: outcomeRetained},
+		{name: "not created", repository: &fakeRepository{}, wantOutcome: outcomeRetained},
+		{
+			name:        "created by another resource",
+			repository:  &fakeRepository{tags: []*ecr.Tag{{Key: aws.String(createdByTagKey), Value: aws.String("stack/Other")}}},
+			wantOutcome: outcomeRetained,
+		},
+		{name: "not found", wantOutcome: outcomeIgnored},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &fakeRepositoryECR{repositories: map[string]*fakeRepository{}}
+			if tt.repository != nil {
+				svc.repositories["mirror/python"] = tt.repository
+			}
+
+			got := deleteRepository(svc, "444093529715", "mirror/python", "stack/Python")
+			if got.Outcome != tt.wantOutcome {
+				t.Errorf("deleteRepository() = %v, want outcome %s", got, tt.wantOutcome)
+			}
+			if exists := tt.repository != nil && !tt.repository.deleted; exists != (tt.repository != nil && tt.wantOutcome != outcomeDeleted) {
+				t.Errorf("deleteRepository() repository exists = %v after outcome %s", exists, got.Outcome)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package container_image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// retryPolicy retries registry requests and operations which failed with a transient error: a 429, a
+// 5xx response or a connection reset.
+type retryPolicy struct {
+	// attempts is the maximum number of attempts of a request or operation.
+	attempts int
+	// delay is the delay before the first retry, which doubles on every retry.
+	delay time.Duration
+	// maxDelay is the maximum delay between attempts. A registry which asks to wait longer is not retried.
+	maxDelay time.Duration
+	// reserve is the time left before the deadline of the context, to report the outcome to CloudFormation.
+	reserve time.Duration
+}
+
+// registryRetryPolicy is the retry policy of the pulls and pushes.
+var registryRetryPolicy = retryPolicy{attempts: 5, delay: time.Second, maxDelay: time.Minute, reserve: 5 * time.Second}
+
+// retryStatusCodes are the response status codes of a transient registry error.
+var retryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// withRetries returns the remote options which retry the requests with the retry policy, instead of the
+// retries by go-containerregistry. The uploaded blobs are recorded in the continuation of the context.
+func withRetries(ctx context.Context, policy retryPolicy, options ...remote.Option) []remote.Option {
+	inner := remote.DefaultTransport
+	if progress := getProgress(ctx); progress != nil {
+		inner = &progressTransport{inner: inner, progress: progress}
+	}
+	return append(options,
+		remote.WithTransport(&retryTransport{inner: inner, policy: policy}),
+		remote.WithRetryStatusCodes(),
+		remote.WithRetryPredicate(func(error) bool { return false }),
+	)
+}
+
+// connectionError is a connection error of a request. It hides the cause from the retries of network
+// errors by go-containerregistry, which cannot be turned off, so a request is only retried by the policy.
+type connectionError struct {
+	err error
+	// retried is true if the retry transport already retried the request.
+	retried bool
+}
+
+func (e *connectionError) Error() string {
+	return e.err.Error()
+}
+
+// retryTransport retries the requests which failed with a transient error, if the request can be sent again.
+type retryTransport struct {
+	inner  http.RoundTripper
+	policy retryPolicy
+}
+
+func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	replayable := isReplayable(request)
+	for attempt := 1; ; attempt++ {
+		response, err := t.inner.RoundTrip(request)
+		if !isTransientResponse(response, err) {
+			return response, err
+		}
+		if !replayable {
+			return response, wrapConnectionError(err, false)
+		}
+
+		delay, ok := t.policy.getDelay(attempt, response)
+		if attempt >= t.policy.attempts || !ok || !t.policy.fits(request.Context(), delay) {
+			return response, wrapConnectionError(err, true)
+		}
+		reason := fmt.Sprint(err)
+		if response != nil {
+			reason = response.Status
+			_, _ = io.Copy(io.Discard, response.Body)
+			_ = response.Body.Close()
+		}
+		log.Printf("retrying %s %s in %s, %s", request.Method, request.URL.Redacted(), delay, reason)
+		if err = sleep(request.Context(), delay); err != nil {
+			return nil, err
+		}
+
+		if request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			request = request.Clone(request.Context())
+			request.Body = body
+		}
+	}
+}
+
+// wrapConnectionError returns the connection error as a connectionError, or nil if there is no error.
+func wrapConnectionError(err error, retried bool) error {
+	if err == nil {
+		return nil
+	}
+	return &connectionError{err: err, retried: retried}
+}
+
+// retry calls the operation until it succeeds, fails with an error which is not transient, or the
+// attempts or the time before the deadline of the context run out.
+func retry(ctx context.Context, policy retryPolicy, operation func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= policy.attempts || !isTransientError(err) {
+			return err
+		}
+		delay, _ := policy.getDelay(attempt, nil)
+		if !policy.fits(ctx, delay) {
+			return err
+		}
+		log.Printf("retrying in %s, %s", delay, err)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// getDelay returns the delay before the next attempt: the delay the registry asks for with the Retry-After
+// or RateLimit headers of the response, or an exponential backoff. It returns false if the registry asks to
+// wait longer than the maximum delay.
+func (p retryPolicy) getDelay(attempt int, response *http.Response) (time.Duration, bool) {
+	if response != nil {
+		if delay, ok := getRetryAfter(response.Header, time.Now()); ok {
+			return delay, delay <= p.maxDelay
+		}
+	}
+	delay := p.delay << (attempt - 1)
+	if delay > p.maxDelay || delay <= 0 {
+		delay = p.maxDelay
+	}
+	return delay, true
+}
+
+// fits returns true if the context has time left for the delay, the reserve and another attempt.
+func (p retryPolicy) fits(ctx context.Context, delay time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > delay+p.reserve
+}
+
+// getRetryAfter returns the delay the registry asks for in the Retry-After header, as seconds or an HTTP
+// date, or in the RateLimit-Reset header. If the RateLimit-Remaining header of Docker Hub, like 0;w=21600,
+// shows the limit is used up, it returns the window of the limit.
+func getRetryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			if delay := date.Sub(now); delay > 0 {
+				return delay, true
+			}
+			return 0, true
+		}
+	}
+	if seconds, err := strconv.Atoi(header.Get("RateLimit-Reset")); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if remaining, parameters, _ := strings.Cut(header.Get("RateLimit-Remaining"), ";"); strings.TrimSpace(remaining) == "0" {
+		for _, parameter := range strings.Split(parameters, ";") {
+			if window, ok := strings.CutPrefix(strings.TrimSpace(parameter), "w="); ok {
+				if seconds, err := strconv.Atoi(window); err == nil && seconds > 0 {
+					return time.Duration(seconds) * time.Second, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// isReplayable returns true if the request can be sent again, as it has no body or a body that can be read again.
+func isReplayable(request *http.Request) bool {
+	return request.Body == nil || request.Body == http.NoBody || request.GetBody != nil
+}
+
+// isTransientResponse returns true if the request failed with a retryable status code or connection error.
+func isTransientResponse(response *http.Response, err error) bool {
+	if err != nil {
+		return isConnectionError(err)
+	}
+	return isRetryableStatus(response.StatusCode)
+}
+
+// isRetryableStatus returns true if the status code is the code of a transient registry error.
+func isRetryableStatus(statusCode int) bool {
+	for _, code := range retryStatusCodes {
+		if statusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientError returns true if the operation failed with a connection error, or with a retryable status
+// code of a request the transport could not send again, like a streamed blob upload. Other requests were
+// already retried by the transport for as long as the registry and the deadline allowed.
+func isTransientError(err error) bool {
+	var connectionErr *connectionError
+	if errors.As(err, &connectionErr) {
+		return !connectionErr.retried
+	}
+	var transportError *transport.Error
+	if errors.As(err, &transportError) {
+		return isRetryableStatus(transportError.StatusCode) && transportError.StatusCode != http.StatusTooManyRequests &&
+			transportError.Request != nil && !isReplayable(transportError.Request)
+	}
+	return isConnectionError(err)
+}
+
+// isConnectionError returns true if the connection to the registry was reset or closed unexpectedly.
+func isConnectionError(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// sleep waits for the delay, or until the context is done.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
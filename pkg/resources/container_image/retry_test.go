@@ -0,0 +1,229 @@
+package container_image
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// faultyRegistry fails the requests of a method to a path prefix, before passing them to the registry.
+type faultyRegistry struct {
+	registry http.Handler
+	method   string
+	path     string
+	// failures is the number of requests to fail, or -1 to fail every request.
+	failures int
+	fail     func(w http.ResponseWriter)
+
+	mu     sync.Mutex
+	failed int
+}
+
+func (f *faultyRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	fail := r.Method == f.method && strings.HasPrefix(r.URL.Path, f.path) && (f.failures < 0 || f.failed < f.failures)
+	if fail {
+		f.failed++
+	}
+	f.mu.Unlock()
+
+	if fail {
+		f.fail(w)
+		return
+	}
+	f.registry.ServeHTTP(w, r)
+}
+
+func respondWith(status int, header map[string]string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for key, value := range header {
+			w.Header().Set(key, value)
+		}
+		w.WriteHeader(status)
+	}
+}
+
+// resetConnection resets the connection of the request.
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	_ = conn.Close()
+}
+
+func Test_copyImage_retry(t *testing.T) {
+	policy := retryPolicy{attempts: 3, delay: time.Millisecond, maxDelay: time.Minute, reserve: 5 * time.Second}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		failures   int
+		fail       func(w http.ResponseWriter)
+		timeout    time.Duration
+		wantFailed int
+		wantErr    bool
+	}{
+		{name: "service unavailable", method: http.MethodGet, path: "/v2/upstream/python/manifests/", failures: 2, fail: respondWith(http.StatusServiceUnavailable, nil), wantFailed: 2},
+		{name: "too many requests", method: http.MethodGet, path: "/v2/upstream/python/manifests/", failures: 1, fail: respondWith(http.StatusTooManyRequests, map[string]string{"Retry-After": "0"}), wantFailed: 1},
+		{name: "rate limit reset", method: http.MethodGet, path: "/v2/upstream/python/manifests/", failures: 1, fail: respondWith(http.StatusTooManyRequests, map[string]string{"RateLimit-Reset": "0"}), wantFailed: 1},
+		{name: "connection reset on pull", method: http.MethodGet, path: "/v2/upstream/python/blobs/", failures: 1, fail: resetConnection, wantFailed: 1},
+		{name: "bad gateway on push", method: http.MethodPut, path: "/v2/target/python/manifests/", failures: 1, fail: respondWith(http.StatusBadGateway, nil), wantFailed: 1},
+		{name: "connection reset on upload", method: http.MethodPatch, path: "/v2/target/python/blobs/uploads/", failures: 1, fail: resetConnection, wantFailed: 1},
+		{name: "rate limit used up", method: http.MethodGet, path: "/v2/upstream/python/manifests/", failures: -1,
+			fail: respondWith(http.StatusTooManyRequests, map[string]string{"RateLimit-Limit": "100;w=21600", "RateLimit-Remaining": "0;w=21600"}), wantFailed: 1, wantErr: true},
+		{name: "retry after the deadline", method: http.MethodGet, path: "/v2/upstream/python/manifests/", failures: -1,
+			fail: respondWith(http.StatusServiceUnavailable, map[string]string{"Retry-After": "30"}), timeout: 10 * time.Second, wantFailed: 1, wantErr: true},
+		{name: "persistent error", method: http.MethodGet, path: "/v2/upstream/python/manifests/", failures: -1, fail: respondWith(http.StatusInternalServerError, nil), wantErr: true},
+		{name: "not found", method: http.MethodGet, path: "/v2/upstream/python/manifests/", failures: -1, fail: respondWith(http.StatusNotFound, nil), wantFailed: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// separate registries, so the blobs are pulled and uploaded rather than mounted
+			source := &faultyRegistry{registry: registry.New(registry.Logger(log.New(io.Discard, "", 0)))}
+			sourceHost := newTestServer(t, source)
+			target := &faultyRegistry{registry: registry.New(registry.Logger(log.New(io.Discard, "", 0)))}
+			targetHost := newTestServer(t, target)
+
+			image, err := random.Image(1024, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = remote.Write(mustParse(sourceHost+"/upstream/python:3.9"), image); err != nil {
+				t.Fatal(err)
+			}
+			for _, faulty := range []*faultyRegistry{source, target} {
+				faulty.method, faulty.path, faulty.failures, faulty.fail = tt.method, tt.path, tt.failures, tt.fail
+			}
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			properties := &resourceProperties{
+				Source: mustParse(sourceHost + "/upstream/python:3.9"),
+				Target: mustParse(targetHost + "/target/python:3.9"),
+			}
+			start := time.Now()
+			_, err = copyImage(ctx, properties, nil, nil, nil, []targetRegistry{&genericTargetRegistry{}}, policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("copyImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if failed := source.failed + target.failed; tt.wantFailed > 0 && failed != tt.wantFailed {
+				t.Errorf("copyImage() failed requests = %d, want %d", failed, tt.wantFailed)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("copyImage() took %s", elapsed)
+			}
+			if !tt.wantErr {
+				if _, err = remote.Head(properties.Target); err != nil {
+					t.Errorf("copyImage() did not push %s, %s", properties.Target, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_getRetryAfter(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   time.Duration
+		wantOk bool
+	}{
+		{name: "none"},
+		{name: "seconds", header: map[string]string{"Retry-After": "120"}, want: 2 * time.Minute, wantOk: true},
+		{name: "date", header: map[string]string{"Retry-After": "Thu, 01 Jun 2023 12:00:30 GMT"}, want: 30 * time.Second, wantOk: true},
+		{name: "past date", header: map[string]string{"Retry-After": "Thu, 01 Jun 2023 11:00:00 GMT"}, wantOk: true},
+		{name: "invalid", header: map[string]string{"Retry-After": "soon"}},
+		{name: "rate limit reset", header: map[string]string{"RateLimit-Reset": "42"}, want: 42 * time.Second, wantOk: true},
+		{name: "rate limit remaining", header: map[string]string{"RateLimit-Remaining": "76;w=21600"}},
+		{name: "rate limit used up", header: map[string]string{"RateLimit-Remaining": "0;w=21600"}, want: 6 * time.Hour, wantOk: true},
+		{name: "retry after precedes rate limit", header: map[string]string{"Retry-After": "5", "RateLimit-Remaining": "0;w=21600"}, want: 5 * time.Second, wantOk: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			for key, value := range tt.header {
+				header.Set(key, value)
+			}
+			got, ok := getRetryAfter(header, now)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("getRetryAfter() = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_withRetries(t *testing.T) {
+	policy := retryPolicy{attempts: 3, delay: time.Millisecond, maxDelay: time.Minute, reserve: 5 * time.Second}
+	layer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pull := func(repository name.Repository, options []remote.Option) error {
+		_, err := remote.Get(repository.Tag("3.9"), options...)
+		return err
+	}
+	upload := func(repository name.Repository, options []remote.Option) error {
+		return remote.WriteLayer(repository, layer, options...)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		fail       func(w http.ResponseWriter)
+		operation  func(repository name.Repository, options []remote.Option) error
+		wantFailed int
+	}{
+		{name: "connection reset on pull", method: http.MethodGet, path: "/v2/target/python/manifests/", fail: resetConnection, operation: pull, wantFailed: 3},
+		{name: "connection reset on upload", method: http.MethodPatch, path: "/v2/target/python/blobs/uploads/", fail: resetConnection, operation: upload, wantFailed: 3},
+		{name: "service unavailable on upload", method: http.MethodPatch, path: "/v2/target/python/blobs/uploads/", fail: respondWith(http.StatusServiceUnavailable, nil), operation: upload, wantFailed: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &faultyRegistry{
+				registry: registry.New(registry.Logger(log.New(io.Discard, "", 0))),
+				method:   tt.method,
+				path:     tt.path,
+				failures: -1,
+				fail:     tt.fail,
+			}
+			// without keep-alive, net/http does not send a request again on a new connection by itself
+			server := httptest.NewServer(target)
+			server.Config.SetKeepAlivesEnabled(false)
+			t.Cleanup(server.Close)
+			repository := mustParse(strings.TrimPrefix(server.URL, "http://") + "/target/python:3.9").Context()
+
+			ctx := context.Background()
+			if err := tt.operation(repository, withRetries(ctx, policy, remote.WithContext(ctx))); err == nil {
+				t.Fatal("the operation succeeded")
+			}
+			// the request is attempted as often as the policy allows, and not retried again by go-containerregistry
+			if target.failed != tt.wantFailed {
+				t.Errorf("failed requests = %d, want %d", target.failed, tt.wantFailed)
+			}
+		})
+	}
+}
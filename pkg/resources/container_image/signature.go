@@ -0,0 +1,473 @@
+package container_image
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+const (
+	// simpleSigningMediaType is the media type of a cosign signature layer.
+	simpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// simpleSigningType is the type of the critical section of a cosign signature payload.
+	simpleSigningType = "cosign container image signature"
+
+	signatureAnnotation   = "dev.cosignproject.cosign/signature"
+	certificateAnnotation = "dev.sigstore.cosign/certificate"
+	chainAnnotation       = "dev.sigstore.cosign/chain"
+	bundleAnnotation      = "dev.sigstore.cosign/bundle"
+)
+
+var (
+	// fulcioIssuerOID is the certificate extension with the OIDC issuer of the signer, as an UTF-8 string.
+	fulcioIssuerOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+	// fulcioIssuerV1OID is the deprecated certificate extension with the OIDC issuer of the signer, as raw bytes.
+	fulcioIssuerV1OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+)
+
+var kmsKeyArnPattern = regexp.MustCompile(`^arn:[a-z-]+:kms:([a-z\d-]+):\d{12}:(key|alias)/.+$`)
+
+// signatureVerification is the VerifySignature configuration. The signature is verified with the
+// PublicKey, the public key of the KMS key, or keyless with a certificate issued by the RootCertificate
+// for the Identity and Issuer, at the time the transparency log with the RekorPublicKey recorded it.
+type signatureVerification struct {
+	PublicKey       string
+	KmsKeyArn       string
+	RootCertificate string
+	Identity        string
+	Issuer          string
+	RekorPublicKey  string
+}
+
+// getSignatureVerification returns the signature verification configuration of the VerifySignature property.
+func getSignatureVerification(value interface{}) (*signatureVerification, error) {
+	properties, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("VerifySignature is not an object")
+	}
+
+	result := &signatureVerification{}
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"PublicKey", &result.PublicKey},
+		{"KmsKeyArn", &result.KmsKeyArn},
+		{"RootCertificate", &result.RootCertificate},
+		{"Identity", &result.Identity},
+		{"Issuer", &result.Issuer},
+		{"RekorPublicKey", &result.RekorPublicKey},
+	} {
+		if value, ok := properties[field.name]; ok {
+			if *field.value, ok = value.(string); !ok || *field.value == "" {
+				return nil, fmt.Errorf("VerifySignature.%s is not a string", field.name)
+			}
+		}
+	}
+
+	keys := 0
+	for _, key := range []string{result.PublicKey, result.KmsKeyArn, result.RootCertificate} {
+		if key != "" {
+			keys++
+		}
+	}
+	if keys != 1 {
+		return nil, fmt.Errorf("VerifySignature requires one of PublicKey, KmsKeyArn or RootCertificate")
+	}
+
+	if result.PublicKey != "" {
+		if _, err := parsePublicKey(result.PublicKey); err != nil {
+			return nil, fmt.Errorf("VerifySignature.PublicKey is invalid, %s", err)
+		}
+	}
+	if result.KmsKeyArn != "" && !kmsKeyArnPattern.MatchString(result.KmsKeyArn) {
+		return nil, fmt.Errorf("VerifySignature.KmsKeyArn is not a KMS key ARN")
+	}
+	if result.RootCertificate != "" {
+		if _, err := parseCertificates(result.RootCertificate); err != nil {
+			return nil, fmt.Errorf("VerifySignature.RootCertificate is invalid, %s", err)
+		}
+		if result.Identity == "" || result.RekorPublicKey == "" {
+			return nil, fmt.Errorf("VerifySignature.RootCertificate requires an Identity and a RekorPublicKey")
+		}
+		if _, err := parsePublicKey(result.RekorPublicKey); err != nil {
+			return nil, fmt.Errorf("VerifySignature.RekorPublicKey is invalid, %s", err)
+		}
+	} else if result.Identity != "" || result.Issuer != "" || result.RekorPublicKey != "" {
+		return nil, fmt.Errorf("VerifySignature.Identity, Issuer and RekorPublicKey require a RootCertificate")
+	}
+	return result, nil
+}
+
+// signatureVerifier verifies the cosign signatures of an image.
+type signatureVerifier struct {
+	// publicKey verifies the signature, or nil for a keyless signature.
+	publicKey crypto.PublicKey
+	roots     *x509.CertPool
+	identity  string
+	issuer    string
+	// rekorPublicKey verifies the transparency log bundle of a keyless signature.
+	rekorPublicKey crypto.PublicKey
+}
+
+// newSignatureVerifier returns the verifier of the configuration, or nil if signatures are not verified.
+func newSignatureVerifier(awsSession client.ConfigProvider, configuration *signatureVerification) (*signatureVerifier, error) {
+	if configuration == nil {
+		return nil, nil
+	}
+
+	if configuration.KmsKeyArn != "" {
+		region := kmsKeyArnPattern.FindStringSubmatch(configuration.KmsKeyArn)[1]
+		publicKey, err := getKMSPublicKey(kms.New(awsSession, aws.NewConfig().WithRegion(region)), configuration.KmsKeyArn)
+		if err != nil {
+			return nil, err
+		}
+		return &signatureVerifier{publicKey: publicKey}, nil
+	}
+	return configuration.verifier()
+}
+
+// verifier returns the verifier of the PublicKey or the RootCertificate.
+func (c *signatureVerification) verifier() (*signatureVerifier, error) {
+	if c.PublicKey != "" {
+		publicKey, err := parsePublicKey(c.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &signatureVerifier{publicKey: publicKey}, nil
+	}
+
+	roots := x509.NewCertPool()
+	certificates, err := parseCertificates(c.RootCertificate)
+	if err != nil {
+		return nil, err
+	}
+	for _, certificate := range certificates {
+		roots.AddCert(certificate)
+	}
+	rekorPublicKey, err := parsePublicKey(c.RekorPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &signatureVerifier{roots: roots, identity: c.Identity, issuer: c.Issuer, rekorPublicKey: rekorPublicKey}, nil
+}
+
+// getKMSPublicKey returns the public key of the KMS key.
+func getKMSPublicKey(svc kmsiface.KMSAPI, keyArn string) (crypto.PublicKey, error) {
+	response, err := svc.GetPublicKey(&kms.GetPublicKeyInput{KeyId: aws.String(keyArn)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the public key of %s, %w", keyArn, err)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(response.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the public key of %s, %w", keyArn, err)
+	}
+	return publicKey, nil
+}
+
+// parsePublicKey returns the public key in the PEM encoded text.
+func parsePublicKey(text string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(text))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("no PEM encoded public key found")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// parseCertificates returns the certificates in the PEM encoded text.
+func parseCertificates(text string) ([]*x509.Certificate, error) {
+	var result []*x509.Certificate
+	for rest := []byte(text); ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, certificate)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return result, nil
+}
+
+// verify returns an error unless the signatures of the image with the digest in the repository contain
+// a valid signature for the digest.
+func (v *signatureVerifier) verify(repository name.Repository, digest v1.Hash, options []remote.Option) error {
+	signatureReference := getCosignReference(repository, digest, cosignSignatureSuffix)
+	signatures, err := remote.Image(signatureReference, options...)
+	if err != nil {
+		return fmt.Errorf("failed to get the signatures of %s from %s, %w", digest, signatureReference, err)
+	}
+	manifest, err := signatures.Manifest()
+	if err != nil {
+		return fmt.Errorf("failed to get the manifest of %s, %w", signatureReference, err)
+	}
+
+	var errs []error
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != simpleSigningMediaType {
+			continue
+		}
+		payload, err := readLayer(signatures, layer.Digest)
+		if err == nil {
+			err = v.verifySignature(payload, digest, layer.Annotations)
+		}
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no signatures in %s", signatureReference)
+	}
+	return fmt.Errorf("no valid signature for %s in %s, %w", digest, signatureReference, errors.Join(errs...))
+}
+
+// readLayer returns the content of the layer of the image.
+func readLayer(image v1.Image, digest v1.Hash) ([]byte, error) {
+	layer, err := image.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// simpleSigningPayload is a cosign signature payload, in the simple signing format.
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// verifySignature verifies the signature in the annotations of the payload, and the digest in the payload.
+func (v *signatureVerifier) verifySignature(payload []byte, digest v1.Hash, annotations map[string]string) error {
+	signature, err := base64.StdEncoding.DecodeString(annotations[signatureAnnotation])
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("the signature is missing or not base64 encoded")
+	}
+
+	publicKey := v.publicKey
+	if publicKey == nil {
+		if publicKey, err = v.verifyCertificate(annotations, payload, signature); err != nil {
+			return err
+		}
+	}
+	if err = verifyPayloadSignature(publicKey, payload, signature); err != nil {
+		return err
+	}
+
+	var content simpleSigningPayload
+	if err = json.Unmarshal(payload, &content); err != nil {
+		return fmt.Errorf("invalid signature payload, %s", err)
+	}
+	if content.Critical.Type != simpleSigningType {
+		return fmt.Errorf("the signature payload is of type %q, not %q", content.Critical.Type, simpleSigningType)
+	}
+	if content.Critical.Image.DockerManifestDigest != digest.String() {
+		return fmt.Errorf("the signature is for %s, not %s", content.Critical.Image.DockerManifestDigest, digest)
+	}
+	return nil
+}
+
+// verifyPayloadSignature verifies the signature of the payload, as created by cosign with the private key.
+func verifyPayloadSignature(publicKey crypto.PublicKey, payload []byte, signature []byte) error {
+	hash := sha256.Sum256(payload)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash[:], signature) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+			if rsa.VerifyPSS(key, crypto.SHA256, hash[:], signature, nil) != nil {
+				return fmt.Errorf("invalid RSA signature")
+			}
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, signature) {
+			return fmt.Errorf("invalid ED25519 signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+	return nil
+}
+
+// rekorBundle is the transparency log bundle of a keyless signature.
+type rekorBundle struct {
+	SignedEntryTimestamp []byte       `json:"SignedEntryTimestamp"`
+	Payload              rekorPayload `json:"Payload"`
+}
+
+// rekorPayload is the transparency log entry signed by the SignedEntryTimestamp. The fields are in the
+// order of the canonical JSON which is signed.
+type rekorPayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// hashedRekordEntry is the body of a transparency log entry of a signature.
+type hashedRekordEntry struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content []byte `json:"content"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verifyBundle returns the time the signature of the payload was entered in the transparency log, after
+// verifying that the bundle is signed by the log and records the signature.
+func (v *signatureVerifier) verifyBundle(annotations map[string]string, payload []byte, signature []byte) (time.Time, error) {
+	var bundle rekorBundle
+	if err := json.Unmarshal([]byte(annotations[bundleAnnotation]), &bundle); err != nil || bundle.Payload.IntegratedTime == 0 || len(bundle.SignedEntryTimestamp) == 0 {
+		return time.Time{}, fmt.Errorf("keyless signature without transparency log bundle")
+	}
+
+	var signed bytes.Buffer
+	encoder := json.NewEncoder(&signed)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(bundle.Payload); err != nil {
+		return time.Time{}, err
+	}
+	if err := verifyPayloadSignature(v.rekorPublicKey, bytes.TrimSuffix(signed.Bytes(), []byte("\n")), bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("the transparency log bundle is not signed by the RekorPublicKey, %s", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log entry, %s", err)
+	}
+	var entry hashedRekordEntry
+	if err = json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log entry, %s", err)
+	}
+	hash := sha256.Sum256(payload)
+	if entry.Kind != "hashedrekord" || entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(hash[:]) ||
+		!bytes.Equal(entry.Spec.Signature.Content, signature) {
+		return time.Time{}, fmt.Errorf("the transparency log entry does not record the signature")
+	}
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+// verifyCertificate returns the public key of the certificate of a keyless signature, after verifying
+// that the certificate was issued by the root for the identity and issuer at the time the signature was
+// entered in the transparency log.
+func (v *signatureVerifier) verifyCertificate(annotations map[string]string, payload []byte, signature []byte) (crypto.PublicKey, error) {
+	certificates, err := parseCertificates(annotations[certificateAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("keyless signature without certificate, %s", err)
+	}
+	certificate := certificates[0]
+
+	intermediates := x509.NewCertPool()
+	if chain, ok := annotations[chainAnnotation]; ok {
+		chainCertificates, err := parseCertificates(chain)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate chain, %s", err)
+		}
+		for _, c := range chainCertificates {
+			intermediates.AddCert(c)
+		}
+	}
+
+	integratedTime, err := v.verifyBundle(annotations, payload, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = certificate.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   integratedTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing certificate, %s", err)
+	}
+
+	if !contains(getCertificateIdentities(certificate), v.identity) {
+		return nil, fmt.Errorf("the signing certificate is not issued to %s, but to %s", v.identity, strings.Join(getCertificateIdentities(certificate), ", "))
+	}
+	if issuer := getCertificateIssuer(certificate); v.issuer != "" && issuer != v.issuer {
+		return nil, fmt.Errorf("the signing certificate is issued by %q, not %s", issuer, v.issuer)
+	}
+	return certificate.PublicKey, nil
+}
+
+// getCertificateIdentities returns the email addresses and URIs of the certificate.
+func getCertificateIdentities(certificate *x509.Certificate) []string {
+	result := append([]string{}, certificate.EmailAddresses...)
+	for _, uri := range certificate.URIs {
+		result = append(result, uri.String())
+	}
+	return result
+}
+
+// getCertificateIssuer returns the OIDC issuer of the signer in the certificate.
+func getCertificateIssuer(certificate *x509.Certificate) string {
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(fulcioIssuerOID) {
+			var issuer string
+			if _, err := asn1.Unmarshal(extension.Value, &issuer); err == nil {
+				return issuer
+			}
+		}
+	}
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(fulcioIssuerV1OID) {
+			return string(extension.Value)
+		}
+	}
+	return ""
+}
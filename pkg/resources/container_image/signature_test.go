@@ -0,0 +1,331 @@
+package container_image
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func mustGenerateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func mustPublicKeyPEM(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// mustCertificate returns a PEM encoded certificate for the key, issued by the parent or self-signed.
+func mustCertificate(t *testing.T, template *x509.Certificate, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, string) {
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// mustBundle returns a transparency log bundle of the signature of the payload, signed by the Rekor key.
+func mustBundle(t *testing.T, rekorKey *ecdsa.PrivateKey, integratedTime time.Time, payload []byte, signature []byte) string {
+	hash := sha256.Sum256(payload)
+	body := fmt.Sprintf(`{"apiVersion":"0.0.1","kind":"hashedrekord","spec":{"data":{"hash":{"algorithm":"sha256","value":%q}},"signature":{"content":%q}}}`,
+		hex.EncodeToString(hash[:]), base64.StdEncoding.EncodeToString(signature))
+	entry := fmt.Sprintf(`{"body":%q,"integratedTime":%d,"logID":"c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d","logIndex":42}`,
+		base64.StdEncoding.EncodeToString([]byte(body)), integratedTime.Unix())
+	entryHash := sha256.Sum256([]byte(entry))
+	signedEntryTimestamp, err := ecdsa.SignASN1(rand.Reader, rekorKey, entryHash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf(`{"SignedEntryTimestamp":%q,"Payload":%s}`, base64.StdEncoding.EncodeToString(signedEntryTimestamp), entry)
+}
+
+// mustSign pushes a cosign signature of the digest, signed with the key, to the repository. The
+// annotations of the signature are returned by annotate, if not nil.
+func mustSign(t *testing.T, repository name.Repository, digest v1.Hash, signedDigest string, key *ecdsa.PrivateKey, annotate func(payload []byte, signature []byte) map[string]string) {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":%q},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, repository.String(), signedDigest))
+	hash := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layerAnnotations := map[string]string{signatureAnnotation: base64.StdEncoding.EncodeToString(signature)}
+	if annotate != nil {
+		for k, v := range annotate(payload, signature) {
+			layerAnnotations[k] = v
+		}
+	}
+	image, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(payload, types.MediaType(simpleSigningMediaType)),
+		Annotations: layerAnnotations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remote.Write(getCosignReference(repository, digest, cosignSignatureSuffix), image); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_signatureVerifier_verify(t *testing.T) {
+	host := newTestRegistry(t)
+
+	key := mustGenerateKey(t)
+	otherKey := mustGenerateKey(t)
+
+	rootKey := mustGenerateKey(t)
+	root, rootPEM := mustCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sigstore"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, rootKey, nil, nil)
+	_, otherRootPEM := mustCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "other"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, mustGenerateKey(t), nil, nil)
+
+	// a short-lived signing certificate, which expired before the verification
+	issuer, _ := asn1.Marshal("https://accounts.example.com")
+	_, signingPEM := mustCertificate(t, &x509.Certificate{
+		SerialNumber:    big.NewInt(3),
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(-50 * time.Minute),
+		EmailAddresses:  []string{"release@example.com"},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		ExtraExtensions: []pkix.Extension{{Id: fulcioIssuerOID, Value: issuer}},
+	}, key, root, rootKey)
+	rekorKey := mustGenerateKey(t)
+	rekorPEM := mustPublicKeyPEM(t, rekorKey)
+	signedAt := time.Now().Add(-55 * time.Minute)
+	keyless := func(payload []byte, signature []byte) map[string]string {
+		return map[string]string{certificateAnnotation: signingPEM, bundleAnnotation: mustBundle(t, rekorKey, signedAt, payload, signature)}
+	}
+	expired := func(payload []byte, signature []byte) map[string]string {
+		return map[string]string{certificateAnnotation: signingPEM, bundleAnnotation: mustBundle(t, rekorKey, time.Now(), payload, signature)}
+	}
+	otherLog := func(payload []byte, signature []byte) map[string]string {
+		return map[string]string{certificateAnnotation: signingPEM, bundleAnnotation: mustBundle(t, mustGenerateKey(t), signedAt, payload, signature)}
+	}
+	otherEntry := func(payload []byte, _ []byte) map[string]string {
+		return map[string]string{certificateAnnotation: signingPEM, bundleAnnotation: mustBundle(t, rekorKey, signedAt, payload, []byte("other signature"))}
+	}
+	// the integrated time of an expired certificate, changed to a time at which the certificate was valid
+	backdated := func(payload []byte, signature []byte) map[string]string {
+		now := time.Now()
+		bundle := mustBundle(t, rekorKey, now, payload, signature)
+		return map[string]string{certificateAnnotation: signingPEM, bundleAnnotation: strings.Replace(bundle, fmt.Sprint(now.Unix()), fmt.Sprint(signedAt.Unix()), 1)}
+	}
+	withoutBundle := func([]byte, []byte) map[string]string {
+		return map[string]string{certificateAnnotation: signingPEM}
+	}
+	keylessVerification := func(root string, identity string, issuer string) signatureVerification {
+		return signatureVerification{RootCertificate: root, Identity: identity, Issuer: issuer, RekorPublicKey: rekorPEM}
+	}
+
+	tests := []struct {
+		name         string
+		verification signatureVerification
+		signingKey   *ecdsa.PrivateKey
+		otherDigest  bool
+		annotations  func(payload []byte, signature []byte) map[string]string
+		unsigned     bool
+		wantErr      bool
+	}{
+		{name: "public key", verification: signatureVerification{PublicKey: mustPublicKeyPEM(t, key)}, signingKey: key},
+		{name: "other key", verification: signatureVerification{PublicKey: mustPublicKeyPEM(t, key)}, signingKey: otherKey, wantErr: true},
+		{name: "other digest", verification: signatureVerification{PublicKey: mustPublicKeyPEM(t, key)}, signingKey: key, otherDigest: true, wantErr: true},
+		{name: "unsigned", verification: signatureVerification{PublicKey: mustPublicKeyPEM(t, key)}, unsigned: true, wantErr: true},
+		{name: "keyless", verification: keylessVerification(rootPEM, "release@example.com", "https://accounts.example.com"), signingKey: key, annotations: keyless},
+		{name: "keyless other identity", verification: keylessVerification(rootPEM, "attacker@example.com", ""), signingKey: key, annotations: keyless, wantErr: true},
+		{name: "keyless other issuer", verification: keylessVerification(rootPEM, "release@example.com", "https://token.actions.githubusercontent.com"), signingKey: key, annotations: keyless, wantErr: true},
+		{name: "keyless other root", verification: keylessVerification(otherRootPEM, "release@example.com", ""), signingKey: key, annotations: keyless, wantErr: true},
+		{name: "keyless expired certificate", verification: keylessVerification(rootPEM, "release@example.com", ""), signingKey: key, annotations: expired, wantErr: true},
+		{name: "keyless backdated bundle", verification: keylessVerification(rootPEM, "release@example.com", ""), signingKey: key, annotations: backdated, wantErr: true},
+		{name: "keyless bundle of another log", verification: keylessVerification(rootPEM, "release@example.com", ""), signingKey: key, annotations: otherLog, wantErr: true},
+		{name: "keyless bundle of another signature", verification: keylessVerification(rootPEM, "release@example.com", ""), signingKey: key, annotations: otherEntry, wantErr: true},
+		{name: "keyless without bundle", verification: keylessVerification(rootPEM, "release@example.com", ""), signingKey: key, annotations: withoutBundle, wantErr: true},
+		{name: "keyless without certificate", verification: keylessVerification(rootPEM, "release@example.com", ""), signingKey: key, wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := mustParse(fmt.Sprintf("%s/signed-%d/python", host, i)).Context()
+			image, err := random.Image(1024, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = remote.Write(repository.Tag("3.9"), image); err != nil {
+				t.Fatal(err)
+			}
+			digest, _ := image.Digest()
+
+			if !tt.unsigned {
+				signedDigest := digest.String()
+				if tt.otherDigest {
+					signedDigest = "sha256:3d35a404db586d00a4ee5a65fd1496fe019ed4bdc068d436a67ce5b64b8b9659"
+				}
+				mustSign(t, repository, digest, signedDigest, tt.signingKey, tt.annotations)
+			}
+
+			verifier, err := tt.verification.verifier()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = verifier.verify(repository, digest, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_copyImage_unsigned(t *testing.T) {
+	host := newTestRegistry(t)
+
+	source := mustParse(host + "/library/python:3.9")
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remote.Write(source, image); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := (&signatureVerification{PublicKey: mustPublicKeyPEM(t, mustGenerateKey(t))}).verifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties := &resourceProperties{Source: source, Target: mustParse(host + "/mirror/python:3.9")}
+	if _, err = copyImage(context.Background(), properties, nil, verifier, nil, []targetRegistry{&genericTargetRegistry{}}, registryRetryPolicy); err == nil {
+		t.Fatal("copyImage() copied an unsigned image")
+	}
+	if _, err = remote.Head(properties.Target); err == nil {
+		t.Errorf("copyImage() pushed %s", properties.Target)
+	}
+}
+
+// fakeKMS is an asymmetric KMS key.
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	publicKey []byte
+	key       *ecdsa.PrivateKey
+}
+
+func (f *fakeKMS) GetPublicKey(*kms.GetPublicKeyInput) (*kms.GetPublicKeyOutput, error) {
+	return &kms.GetPublicKeyOutput{PublicKey: f.publicKey}, nil
+}
+
+func (f *fakeKMS) Sign(input *kms.SignInput) (*kms.SignOutput, error) {
+	if aws.StringValue(input.MessageType) != kms.MessageTypeDigest || aws.StringValue(input.SigningAlgorithm) != kms.SigningAlgorithmSpecEcdsaSha256 {
+		return nil, fmt.Errorf("unexpected message type %s or signing algorithm %s", aws.StringValue(input.MessageType), aws.StringValue(input.SigningAlgorithm))
+	}
+	signature, err := ecdsa.SignASN1(rand.Reader, f.key, input.Message)
+	return &kms.SignOutput{Signature: signature}, err
+}
+
+func Test_getKMSPublicKey(t *testing.T) {
+	key := mustGenerateKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := getKMSPublicKey(&fakeKMS{publicKey: der}, "arn:aws:kms:eu-central-1:444093529715:alias/cosign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(publicKey) {
+		t.Errorf("getKMSPublicKey() = %v, want %v", publicKey, key.PublicKey)
+	}
+}
+
+func Test_getSignatureVerification(t *testing.T) {
+	publicKey := mustPublicKeyPEM(t, mustGenerateKey(t))
+	_, rootCertificate := mustCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sigstore"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, mustGenerateKey(t), nil, nil)
+	tests := []struct {
+		name    string
+		value   interface{}
+		wantErr string
+	}{
+		{name: "public key", value: map[string]interface{}{"PublicKey": publicKey}},
+		{name: "kms key", value: map[string]interface{}{"KmsKeyArn": "arn:aws:kms:eu-central-1:444093529715:key/1234abcd-12ab-34cd-56ef-1234567890ab"}},
+		{name: "not an object", value: "true", wantErr: "VerifySignature is not an object"},
+		{name: "no key", value: map[string]interface{}{}, wantErr: "VerifySignature requires one of PublicKey, KmsKeyArn or RootCertificate"},
+		{name: "two keys", value: map[string]interface{}{"PublicKey": publicKey, "KmsKeyArn": "arn:aws:kms:eu-central-1:444093529715:alias/cosign"}, wantErr: "VerifySignature requires one of PublicKey, KmsKeyArn or RootCertificate"},
+		{name: "invalid public key", value: map[string]interface{}{"PublicKey": "ssh-rsa AAAA"}, wantErr: "VerifySignature.PublicKey is invalid, no PEM encoded public key found"},
+		{name: "invalid kms key", value: map[string]interface{}{"KmsKeyArn": "alias/cosign"}, wantErr: "VerifySignature.KmsKeyArn is not a KMS key ARN"},
+		{name: "invalid root certificate", value: map[string]interface{}{"RootCertificate": publicKey}, wantErr: "VerifySignature.RootCertificate is invalid, no PEM encoded certificate found"},
+		{name: "identity with key", value: map[string]interface{}{"PublicKey": publicKey, "Identity": "release@example.com"}, wantErr: "VerifySignature.Identity, Issuer and RekorPublicKey require a RootCertificate"},
+		{name: "root certificate", value: map[string]interface{}{"RootCertificate": rootCertificate, "Identity": "release@example.com", "RekorPublicKey": publicKey}},
+		{name: "root certificate without identity", value: map[string]interface{}{"RootCertificate": rootCertificate, "RekorPublicKey": publicKey},
+			wantErr: "VerifySignature.RootCertificate requires an Identity and a RekorPublicKey"},
+		{name: "root certificate without rekor key", value: map[string]interface{}{"RootCertificate": rootCertificate, "Identity": "release@example.com"},
+			wantErr: "VerifySignature.RootCertificate requires an Identity and a RekorPublicKey"},
+		{name: "invalid rekor key", value: map[string]interface{}{"RootCertificate": rootCertificate, "Identity": "release@example.com", "RekorPublicKey": rootCertificate},
+			wantErr: "VerifySignature.RekorPublicKey is invalid, no PEM encoded public key found"},
+		{name: "identity not a string", value: map[string]interface{}{"PublicKey": publicKey, "Identity": 1}, wantErr: "VerifySignature.Identity is not a string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := getSignatureVerification(tt.value)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("getSignatureVerification() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
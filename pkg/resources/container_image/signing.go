@@ -0,0 +1,181 @@
+package container_image
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// signer signs the copied image.
+type signer interface {
+	// publicKey returns the public key the signatures are verified with.
+	publicKey() (crypto.PublicKey, error)
+	// sign returns the signature of the SHA-256 digest of a payload.
+	sign(digest []byte) ([]byte, error)
+}
+
+// newSigner returns the signer of the KMS key, or nil if the image is not signed.
+func newSigner(awsSession client.ConfigProvider, keyArn string) signer {
+	if keyArn == "" {
+		return nil
+	}
+	region := kmsKeyArnPattern.FindStringSubmatch(keyArn)[1]
+	return &kmsSigner{svc: kms.New(awsSession, aws.NewConfig().WithRegion(region)), keyArn: keyArn}
+}
+
+// kmsSigner signs with an asymmetric KMS key.
+type kmsSigner struct {
+	svc    kmsiface.KMSAPI
+	keyArn string
+
+	once      sync.Once
+	key       crypto.PublicKey
+	algorithm string
+	err       error
+}
+
+// publicKey returns the public key of the KMS key, and determines the signing algorithm from it.
+func (s *kmsSigner) publicKey() (crypto.PublicKey, error) {
+	s.once.Do(func() {
+		if s.key, s.err = getKMSPublicKey(s.svc, s.keyArn); s.err != nil {
+			return
+		}
+		switch key := s.key.(type) {
+		case *ecdsa.PublicKey:
+			if key.Curve != elliptic.P256() {
+				s.err = fmt.Errorf("KMS key %s is not an ECC_NIST_P256 or RSA key", s.keyArn)
+			}
+			s.algorithm = kms.SigningAlgorithmSpecEcdsaSha256
+		case *rsa.PublicKey:
+			s.algorithm = kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256
+		default:
+			s.err = fmt.Errorf("KMS key %s is not an ECC_NIST_P256 or RSA key", s.keyArn)
+		}
+	})
+	return s.key, s.err
+}
+
+func (s *kmsSigner) sign(digest []byte) ([]byte, error) {
+	if _, err := s.publicKey(); err != nil {
+		return nil, err
+	}
+	response, err := s.svc.Sign(&kms.SignInput{
+		KeyId:            aws.String(s.keyArn),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(s.algorithm),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with %s, %w", s.keyArn, err)
+	}
+	return response.Signature, nil
+}
+
+// getSignaturePayload returns the cosign signature payload of the image with the digest in the repository.
+func getSignaturePayload(repository name.Repository, digest v1.Hash) ([]byte, error) {
+	var payload simpleSigningPayload
+	payload.Critical.Identity.DockerReference = repository.Name()
+	payload.Critical.Image.DockerManifestDigest = digest.String()
+	payload.Critical.Type = simpleSigningType
+	return json.Marshal(payload)
+}
+
+// signImage adds a cosign signature of the image with the digest to the signatures of the image in the
+// repository, and returns the digest of the signatures. If the signatures already contain a valid
+// signature by the signer, the image is not signed again.
+func signImage(repository name.Repository, digest v1.Hash, signer signer, options []remote.Option) (v1.Hash, error) {
+	payload, err := getSignaturePayload(repository, digest)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	publicKey, err := signer.publicKey()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	signatureReference := getCosignReference(repository, digest, cosignSignatureSuffix)
+	signatures, err := remote.Image(signatureReference, options...)
+	if isNotFound(err) {
+		signatures = mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	} else if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to get the signatures of %s: %w", digest, err)
+	} else if isSignedBy(signatures, payload, publicKey) {
+		log.Printf("%s is already signed in %s", digest, signatureReference)
+		return signatures.Digest()
+	}
+
+	hash := sha256.Sum256(payload)
+	signature, err := signer.sign(hash[:])
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	signatures, err = mutate.Append(signatures, mutate.Addendum{
+		Layer:       static.NewLayer(payload, simpleSigningMediaType),
+		Annotations: map[string]string{signatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+	})
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to add the signature of %s: %w", digest, err)
+	}
+	if err = remote.Write(signatureReference, signatures, options...); err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to push the signature to %s: %w", signatureReference, err)
+	}
+	log.Printf("signed %s in %s", digest, signatureReference)
+	return signatures.Digest()
+}
+
+// isSignedBy returns true if the signatures contain a valid signature of the payload with the public key.
+func isSignedBy(signatures v1.Image, payload []byte, publicKey crypto.PublicKey) bool {
+	manifest, err := signatures.Manifest()
+	if err != nil {
+		return false
+	}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != simpleSigningMediaType {
+			continue
+		}
+		content, err := readLayer(signatures, layer.Digest)
+		if err != nil || !bytes.Equal(content, payload) {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[signatureAnnotation])
+		if err == nil && verifyPayloadSignature(publicKey, payload, signature) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// signTarget signs the image in the target, and returns the digest of its signatures.
+func signTarget(ctx context.Context, target name.Reference, image *sourceImage, signer signer, authenticator authn.Authenticator) (string, error) {
+	options := []remote.Option{
+		remote.WithAuth(authenticator),
+		remote.WithContext(ctx),
+	}
+	digest, err := signImage(target.Context(), image.digest, signer, options)
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
@@ -0,0 +1,119 @@
+package container_image
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// ecdsaSigner signs with an in-memory key.
+type ecdsaSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (s *ecdsaSigner) publicKey() (crypto.PublicKey, error) {
+	return &s.key.PublicKey, nil
+}
+
+func (s *ecdsaSigner) sign(digest []byte) ([]byte, error) {
+	return ecdsa.SignASN1(rand.Reader, s.key, digest)
+}
+
+func Test_signImage(t *testing.T) {
+	host := newTestRegistry(t)
+
+	key := mustGenerateKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamKey := mustGenerateKey(t)
+
+	tests := []struct {
+		name     string
+		signer   signer
+		upstream bool
+	}{
+		{name: "in-memory", signer: &ecdsaSigner{key: key}},
+		{name: "kms", signer: &kmsSigner{svc: &fakeKMS{publicKey: der, key: key}, keyArn: "arn:aws:kms:eu-central-1:444093529715:alias/cosign"}},
+		{name: "upstream signature", signer: &ecdsaSigner{key: key}, upstream: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := mustParse(host + "/" + strings.ReplaceAll(tt.name, " ", "-") + "/python").Context()
+			image, err := random.Image(1024, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = remote.Write(repository.Tag("3.9"), image); err != nil {
+				t.Fatal(err)
+			}
+			digest, _ := image.Digest()
+			if tt.upstream {
+				mustSign(t, repository, digest, digest.String(), upstreamKey, nil)
+			}
+
+			signatures, err := signImage(repository, digest, tt.signer, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// signing again keeps the existing signature
+			if again, err := signImage(repository, digest, tt.signer, nil); err != nil || again != signatures {
+				t.Errorf("signImage() again = %s, %v, want %s", again, err, signatures)
+			}
+			if descriptor, err := remote.Head(getCosignReference(repository, digest, cosignSignatureSuffix)); err != nil || descriptor.Digest != signatures {
+				t.Errorf("signImage() = %s, want the digest of the signatures %v", signatures, descriptor)
+			}
+
+			keys := []*ecdsa.PrivateKey{key}
+			if tt.upstream {
+				keys = append(keys, upstreamKey)
+			}
+			for _, k := range keys {
+				verifier := &signatureVerifier{publicKey: &k.PublicKey}
+				if err = verifier.verify(repository, digest, nil); err != nil {
+					t.Errorf("verify() error = %v", err)
+				}
+			}
+		})
+	}
+}
+
+func Test_copyImage_signWith(t *testing.T) {
+	host := newTestRegistry(t)
+
+	source := mustParse(host + "/library/python:3.9")
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remote.Write(source, image); err != nil {
+		t.Fatal(err)
+	}
+
+	properties := &resourceProperties{Source: source, Target: mustParse(host + "/eu-central-1/python:3.9")}
+	properties.Repositories = append(properties.Repositories, properties.Target.Context(), mustParse(host+"/eu-west-1/python").Context())
+	signer := &ecdsaSigner{key: mustGenerateKey(t)}
+	data, err := copyImage(context.Background(), properties, nil, nil, signer, []targetRegistry{&genericTargetRegistry{}, &genericTargetRegistry{}}, registryRetryPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, _ := image.Digest()
+	for i, target := range properties.getTargets() {
+		descriptor, err := remote.Head(getCosignReference(target.Context(), digest, cosignSignatureSuffix))
+		if err != nil {
+			t.Fatalf("copyImage() did not sign %s, %s", target, err)
+		}
+		if i == 0 && data["SignatureDigest"] != descriptor.Digest.String() {
+			t.Errorf("copyImage() SignatureDigest = %s, want %s", data["SignatureDigest"], descriptor.Digest)
+		}
+	}
+}
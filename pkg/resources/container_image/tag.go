@@ -0,0 +1,140 @@
+package container_image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// tagTemplateData is the source metadata available in TargetTag and AdditionalTags templates,
+// for instance `{{.SourceTag}}-{{.ShortDigest}}` or `{{.Label "org.opencontainers.image.version"}}`.
+type tagTemplateData struct {
+	SourceName  string
+	SourceTag   string
+	Digest      string
+	ShortDigest string
+	labels      map[string]string
+}
+
+// Label returns the value of the label in the image config, or an empty string if the label is not set.
+func (d tagTemplateData) Label(name string) string {
+	return d.labels[name]
+}
+
+func isTagTemplate(tag string) bool {
+	return strings.Contains(tag, "{{")
+}
+
+func parseTagTemplate(tag string) (*template.Template, error) {
+	return template.New("tag").Option("missingkey=error").Parse(tag)
+}
+
+// validateTag checks that the tag is valid. Templates are executed against empty data, so that
+// syntax errors and references to unknown fields are detected before the image is pulled.
+func validateTag(tag string) error {
+	if !isTagTemplate(tag) {
+		if !tagPattern.MatchString(tag) {
+			return fmt.Errorf("%s is not a valid tag", tag)
+		}
+		return nil
+	}
+
+	t, err := parseTagTemplate(tag)
+	if err != nil {
+		return err
+	}
+	return t.Execute(io.Discard, tagTemplateData{})
+}
+
+// expandTag returns the tag with the template expanded against the data.
+func expandTag(tag string, data *tagTemplateData) (string, error) {
+	if !isTagTemplate(tag) {
+		return tag, nil
+	}
+
+	t, err := parseTagTemplate(tag)
+	if err != nil {
+		return "", err
+	}
+
+	var result strings.Builder
+	if err = t.Execute(&result, data); err != nil {
+		return "", err
+	}
+	if !tagPattern.MatchString(result.String()) {
+		return "", fmt.Errorf("%s expanded to the invalid tag %q", tag, result.String())
+	}
+	return result.String(), nil
+}
+
+// hasTagTemplates returns true if the TargetTag or any of the AdditionalTags is a template.
+func (p *resourceProperties) hasTagTemplates() bool {
+	if isTagTemplate(p.TargetTag) {
+		return true
+	}
+	for _, tag := range p.AdditionalTags {
+		if isTagTemplate(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// getTagTemplateData returns the template data of the artifact. The labels are read from the
+// config of the artifact or, for an image index, of the default platform image in the descriptor.
+func getTagTemplateData(properties *resourceProperties, descriptor *remote.Descriptor, artifact remote.Taggable) (*tagTemplateData, error) {
+	manifest, err := artifact.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(manifest))
+	if err != nil {
+		return nil, err
+	}
+
+	image, ok := artifact.(v1.Image)
+	if !ok {
+		if image, err = descriptor.Image(); err != nil {
+			return nil, fmt.Errorf("failed to get the image for the labels: %w", err)
+		}
+	}
+	config, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the image config for the labels: %w", err)
+	}
+
+	return &tagTemplateData{
+		SourceName:  properties.SourceName,
+		SourceTag:   properties.SourceTag,
+		Digest:      digest.String(),
+		ShortDigest: digest.Hex[:12],
+		labels:      config.Config.Labels,
+	}, nil
+}
+
+// expandTags expands the templates in the TargetTag and AdditionalTags of the properties. Until
+// then, the Target is tagged with the source tag or digest; it is updated to the expanded TargetTag.
+func (p *resourceProperties) expandTags(data *tagTemplateData) error {
+	if isTagTemplate(p.TargetTag) {
+		tag, err := expandTag(p.TargetTag, data)
+		if err != nil {
+			return fmt.Errorf("invalid TargetTag, %w", err)
+		}
+		p.TargetTag = tag
+		p.Target = p.Target.Context().Tag(tag)
+	}
+
+	for i, tag := range p.AdditionalTags {
+		expanded, err := expandTag(tag, data)
+		if err != nil {
+			return fmt.Errorf("invalid AdditionalTags, %w", err)
+		}
+		p.AdditionalTags[i] = expanded
+	}
+	return nil
+}
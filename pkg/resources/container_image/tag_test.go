@@ -0,0 +1,93 @@
+package container_image
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func Test_validateTag(t *testing.T) {
+	tests := []struct {
+		name           string
+		tag            string
+		wantErrMessage string
+	}{
+		{name: "static", tag: "3.9"},
+		{name: "template", tag: "{{.SourceTag}}-{{.ShortDigest}}"},
+		{name: "label", tag: `{{.Label "org.opencontainers.image.version"}}`},
+		{name: "invalid static", tag: "3.9/latest", wantErrMessage: "3.9/latest is not a valid tag"},
+		{name: "syntax error", tag: "{{.SourceTag", wantErrMessage: `template: tag:1: unclosed action`},
+		{name: "unknown field", tag: "{{.Version}}", wantErrMessage: `template: tag:1:2: executing "tag" at <.Version>: can't evaluate field Version in type container_image.tagTemplateData`},
+		{name: "missing label name", tag: "{{.Label}}", wantErrMessage: `template: tag:1:2: executing "tag" at <.Label>: wrong number of args for Label: want 1 got 0`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTag(tt.tag)
+			if tt.wantErrMessage == "" && err != nil {
+				t.Errorf("validateTag() error = %v", err)
+			}
+			if tt.wantErrMessage != "" && (err == nil || err.Error() != tt.wantErrMessage) {
+				t.Errorf("validateTag() error = %v, wantErrMessage %v", err, tt.wantErrMessage)
+			}
+		})
+	}
+}
+
+func Test_expandTags(t *testing.T) {
+	image, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := image.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Config.Labels = map[string]string{"org.opencontainers.image.version": "1.2.3"}
+	if image, err = mutate.ConfigFile(image, config); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	properties := &resourceProperties{
+		Target:         mustParse("444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:3.9"),
+		SourceName:     "docker.io/library/python",
+		SourceTag:      "3.9",
+		TargetTag:      "{{.SourceTag}}-{{.ShortDigest}}",
+		AdditionalTags: []string{"stable", `v{{.Label "org.opencontainers.image.version"}}`},
+	}
+	if !properties.hasTagTemplates() {
+		t.Fatalf("hasTagTemplates() = false, want true")
+	}
+
+	data, err := getTagTemplateData(properties, nil, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Digest != digest.String() {
+		t.Errorf("getTagTemplateData() Digest = %s, want %s", data.Digest, digest)
+	}
+
+	if err = properties.expandTags(data); err != nil {
+		t.Fatal(err)
+	}
+
+	wantTag := "3.9-" + digest.Hex[:12]
+	if properties.TargetTag != wantTag {
+		t.Errorf("expandTags() TargetTag = %s, want %s", properties.TargetTag, wantTag)
+	}
+	if want := "444093529715.dkr.ecr.eu-central-1.amazonaws.com/python:" + wantTag; properties.Target.String() != want {
+		t.Errorf("expandTags() Target = %s, want %s", properties.Target, want)
+	}
+	if properties.AdditionalTags[0] != "stable" || properties.AdditionalTags[1] != "v1.2.3" {
+		t.Errorf("expandTags() AdditionalTags = %v, want [stable v1.2.3]", properties.AdditionalTags)
+	}
+
+	properties.TargetTag = `{{.Label "org.example.missing"}}`
+	if err = properties.expandTags(data); err == nil || err.Error() != `invalid TargetTag, {{.Label "org.example.missing"}} expanded to the invalid tag ""` {
+		t.Errorf("expandTags() error = %v", err)
+	}
+}